@@ -24,7 +24,9 @@ import (
 	"net/http"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"fortio.org/dflag"
 	"fortio.org/fortio/fhttp"
@@ -46,19 +48,35 @@ func (f *headersFlagList) Set(value string) error {
 
 // -- end of functions for -H support
 
+// -- Support for multiple instances of -expect-header flag on cmd line.
+type expectHeadersFlagList []string
+
+func (f *expectHeadersFlagList) String() string {
+	return ""
+}
+
+func (f *expectHeadersFlagList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 // FortioHook is used in cli and rapi to customize the run and introduce for instance clienttrace
 // and otel access logger.
 type FortioHook func(*fhttp.HTTPOptions, *periodic.RunnerOptions)
 
 var (
-	compressionFlag = flag.Bool("compression", false, "Enable http compression")
+	compressionFlag = flag.Bool("compression", false, "Enable http compression (the fast client only requests it, see -decompress)")
+	decompressFlag  = flag.Bool("decompress", false, "Fast client: decode gzip/deflate responses, implies -compression")
 	keepAliveFlag   = flag.Bool("keepalive", true, "Keep connection alive (only for fast http 1.1)")
 	halfCloseFlag   = flag.Bool("halfclose", false,
 		"When not keepalive, whether to half close the connection (only for fast http)")
 	httpReqTimeoutFlag  = flag.Duration("timeout", fhttp.HTTPReqTimeOutDefaultValue, "Connection and read timeout value (for http)")
-	stdClientFlag       = flag.Bool("stdclient", false, "Use the slower net/http standard client (slower but supports h2/h2c)")
+	stdClientFlag       = flag.Bool("stdclient", false, "Use the slower net/http standard client (supports streaming payloads)")
 	http10Flag          = flag.Bool("http1.0", false, "Use http1.0 (instead of http 1.1)")
 	h2Flag              = flag.Bool("h2", false, "Attempt to use http2.0 / h2 (instead of http 1.1) for both TLS and h2c")
+	h2FastFlag          = flag.Bool("h2-fast", false, "Use the fast client for -h2 (instead of switching to the std client)")
+	h2StreamsFlag       = flag.Int("h2-streams", 1, "Number of threads (-c) sharing each h2 connection of the fast client (-h2-fast)")
+	pipelineFlag        = flag.Int("pipeline", 0, "Number of http/1.1 requests the fast client pipelines (sends back to back)")
 	httpsInsecureFlag   = flag.Bool("k", false, "Do not verify certs in https/tls/grpc connections")
 	httpsInsecureFlagL  = flag.Bool("https-insecure", false, "Long form of the -k flag")
 	resolve             = flag.String("resolve", "", "Resolve host name to this `IP`")
@@ -67,6 +85,8 @@ var (
 	followRedirectsFlag = flag.Bool("L", false, "Follow redirects (implies -std-client) - do not use for load test")
 	userCredentialsFlag = flag.String("user", "", "User credentials for basic authentication (for http). Input data format"+
 		" should be `user:password`")
+	methodFlag = flag.String("X", "",
+		"Http `method` to use (e.g. PUT, DELETE, HEAD) instead of the default GET, or POST when there is a payload")
 	contentTypeFlag = flag.String("content-type", "",
 		"Sets http content type. Setting this value switches the request method from GET to POST.")
 	// PayloadSizeFlag is the value of -payload-size.
@@ -89,6 +109,16 @@ var (
 		"`Path` to a custom CA certificate file to be used for the TLS client connections, "+
 			"if empty, use https:// prefix for standard internet/system CAs")
 	mTLS = flag.Bool("mtls", false, "Require client certificate signed by -cacert for client connections")
+	// TLS handshake flags.
+	tlsMinFlag     = flag.String("tls-min", "", "Minimum TLS `version` (1.0 to 1.3) for clients and servers (default 1.2)")
+	tlsMaxFlag     = flag.String("tls-max", "", "Maximum TLS `version` (1.0 to 1.3) for clients and servers")
+	tlsCiphersFlag = flag.String("tls-ciphers", "",
+		"Comma separated list of TLS 1.2 and below cipher suite `names`, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	tlsCurvesFlag     = flag.String("tls-curves", "", "Comma separated list of preferred TLS `curves` (X25519, P256, P384, P521)")
+	sniFlag           = flag.String("sni", "", "TLS server `name` (SNI) override for the https/grpc clients")
+	alpnFlag          = flag.String("alpn", "", "Comma separated list of ALPN `protocols` to offer/accept, e.g. h2,http/1.1")
+	tlsResumptionFlag = flag.String("tls-resumption", "",
+		"TLS session resumption `on|off`, default is off for clients and on for servers")
 	// LogErrorsFlag determines if the non ok http error codes get logged as they occur or not.
 	LogErrorsFlag = flag.Bool("log-errors", true, "Log http non 2xx/418 error codes as they occur")
 	// RunIDFlag is optional RunID to be present in json results (and default json result filename if not 0).
@@ -98,6 +128,15 @@ var (
 		"http(s) runner warmup done in parallel instead of sequentially. When set, restores pre 1.21 behavior")
 	curlHeadersStdout = flag.Bool("curl-stdout-headers", false,
 		"Restore pre 1.22 behavior where http headers of the fast client are output to stdout in curl mode. now stderr by default.")
+	writeOutFlag = flag.String("w", "",
+		"Curl mode write-out `format` (or @file) output after the body, with curl like %{variable}s e.g. "+
+			"%{http_code} %{time_total}, or %{json} for all of them")
+	outputFlag     = flag.String("o", "", "Curl mode: write the response body to this `file` instead of stdout")
+	dumpHeaderFlag = flag.String("D", "", "Curl mode: write the response status line and headers to this `file` (- for stdout)")
+	headOnlyFlag   = flag.Bool("I", false, "Make HEAD requests (and output the response headers to stdout in curl mode)")
+	failFlag       = flag.Bool("fail", false,
+		"Curl mode: exit like curl -f, with 22 for http errors (status >= 400) and 7 for connection errors, "+
+			"instead of 1 for any non 200 status")
 	// ConnectionReuseRange Dynamic string flag to set the max connection reuse range.
 	ConnectionReuseRange = dflag.Flag("connection-reuse", dflag.New("",
 		"Range `min:max` for the max number of connections to reuse for each thread, default to unlimited. "+
@@ -106,14 +145,55 @@ var (
 	// NoReResolveFlag is false if we want to resolve the DNS name for each new connection.
 	NoReResolveFlag = flag.Bool("no-reresolve", false, "Keep the initial DNS resolution and "+
 		"don't re-resolve when making new connections (because of error or reuse limit reached)")
+	sourceAddrFlag = flag.String("source-addr", "",
+		"Bind outgoing connections to these local `ips`, round robin per connection, "+
+			"with optional port range, e.g. 10.0.0.1,10.0.0.2:20000-30000")
+	proxyFlag = flag.String("proxy", "",
+		"Egress proxy `url` for the http clients, http://[user:password@]host:port (CONNECT for https) or socks5://...")
+	// Session flags.
+	cookiesFlag = flag.Bool("cookies", false, "Keep the cookies received by each client (thread) and send them in its next requests")
+	loginFlag   = flag.String("login", "",
+		"Optional login `url` (can be relative to the main url) each client (thread) calls once before the run, implies -cookies")
+	loginPayloadFlag = flag.String("login-payload", "", "Payload for the -login request (POST), e.g. user=u&password=p or json")
+	loginTokenFlag   = flag.String("login-token", "",
+		"Dot separated `path` of a token in the -login json response to send as Bearer Authorization, e.g. data.token")
+	// Retry policy flags.
+	retriesFlag = flag.Int("retries", 0, "Maximum number of `retries` of each failed call by the http and grpc runners")
+	retryOnFlag = flag.String("retry-on", "socket",
+		"Comma separated list of `codes` to retry on: http status (or 5xx), grpc status numbers, socket for connection/any error")
+	retryBackoffFlag    = flag.Duration("retry-backoff", 0, "Wait before the first retry, doubled for each subsequent one")
+	retryMaxBackoffFlag = flag.Duration("retry-max-backoff", 0, "Maximum wait between retries (0 for no limit)")
+	// Response validation flags.
+	expectStatusFlag = flag.String("expect-status", "",
+		"Comma separated list of accepted http status `codes`, others count as errors (default 2xx and 418)")
+	expectBodyFlag  = flag.String("expect-body", "", "Responses not containing this `string` count as errors")
+	expectRegexFlag = flag.String("expect-regex", "", "Responses not matching this `regexp` count as errors")
+	expectJSONFlag  = flag.String("expect-json", "",
+		"Responses without this `path[=value]` in their json body count as errors, e.g. data.items.0.status=ok")
+	expectSizeFlag   = flag.Int64("expect-size", 0, "Responses whose body isn't exactly this `size` count as errors")
+	expectSHA256Flag = flag.String("expect-sha256", "", "Responses whose body doesn't have this hex sha256 `checksum` count as errors")
+	expectHeaders    expectHeadersFlagList
 )
 
+// commaList splits the comma separated list s, nil when empty.
+func commaList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 // SharedMain is the common part of main from fortio_main and fcurl.
 // It sets up the common flags, the rest of usage/argument/flag handling
 // is now moved to the [fortio.org/cli] and [fortio.org/scli] packages.
 func SharedMain() {
 	flag.Var(&headersFlags, "H",
 		"Additional http header(s) or grpc metadata. Multiple `key:value` pairs can be passed using multiple -H.")
+	flag.Var(&expectHeaders, "expect-header",
+		"Responses without this header count as errors. `name[:value]`, can be repeated")
 	flag.IntVar(&fhttp.BufferSizeKb, "httpbufferkb", fhttp.BufferSizeKb,
 		"Size of the buffer (max data size) for the optimized http client in `kbytes`")
 	flag.BoolVar(&fhttp.CheckConnectionClosedHeader, "httpccch", fhttp.CheckConnectionClosedHeader,
@@ -128,6 +208,11 @@ func SharedMain() {
 	// first just picks the first answer, rr rounds robin on each answer.
 	dflag.Flag("dns-method", fnet.FlagResolveMethod)
 	dflag.Flag("echo-server-default-params", fhttp.DefaultEchoServerParams)
+	dflag.Flag("echo-server-routes", fhttp.EchoRoutes)
+	dflag.Flag("echo-server-rate-limit", fhttp.EchoRateLimit)
+	dflag.Flag("echo-server-rate-limit-key", fhttp.EchoRateLimitKey)
+	dflag.Flag("echo-server-capture", fhttp.EchoCaptureSize)
+	dflag.FlagBool("server-metrics", fhttp.ServerMetrics)
 	dflag.FlagBool("proxy-all-headers", fhttp.Fetch2CopiesAllHeader)
 	dflag.Flag("server-idle-timeout", fhttp.ServerIdleTimeout)
 	// MaxDelay is the maximum delay allowed for the echoserver responses.
@@ -136,12 +221,68 @@ func SharedMain() {
 	// call [scli.ServerMain()] to complete the setup.
 }
 
-// FetchURL is fetching url content and exiting with 1 upon error.
+// Curl mode exit codes (same as curl's), with -fail for the first 2.
+const (
+	ExitConnectError = 7
+	ExitHTTPError    = 22
+	ExitWriteError   = 23
+)
+
+// createOutput returns stdout for "-" or the created file at path, exits on error.
+func createOutput(path string) *os.File {
+	if path == "-" {
+		return os.Stdout
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Errf("Unable to create output file: %v", err)
+		os.Exit(ExitWriteError)
+	}
+	return f
+}
+
+func closeOutput(f *os.File) {
+	if f == os.Stdout || f == os.Stderr {
+		return
+	}
+	if err := f.Close(); err != nil {
+		log.Errf("Unable to close output file: %v", err)
+		os.Exit(ExitWriteError)
+	}
+}
+
+// FetchURL is fetching url content and exiting with 1 upon error
+// (or with the curl codes when -fail is set).
 // common part between fortio_main and fcurl.
 func FetchURL(o *fhttp.HTTPOptions) {
 	// keepAlive could be just false when making 1 fetch but it helps debugging
 	// the http client when making a single request if using the flags
-	o.DataWriter = os.Stdout
+	bodyOut, headerOut := os.Stdout, os.Stderr
+	if *outputFlag != "" {
+		bodyOut = createOutput(*outputFlag)
+	}
+	if *curlHeadersStdout || *headOnlyFlag {
+		headerOut = os.Stdout
+	}
+	if *dumpHeaderFlag != "" {
+		headerOut = createOutput(*dumpHeaderFlag)
+	}
+	o.DataWriter = bodyOut
+	if *headOnlyFlag || *dumpHeaderFlag != "" {
+		o.HeaderWriter = headerOut // the std client only outputs the headers when asked
+	}
+	writeOut := *writeOutFlag
+	if strings.HasPrefix(writeOut, "@") {
+		data, err := os.ReadFile(writeOut[1:])
+		if err != nil {
+			log.Errf("Unable to read write-out format file: %v", err)
+			os.Exit(1)
+		}
+		writeOut = string(data)
+	}
+	if writeOut != "" {
+		o.FetchInfo = &fhttp.FetchInfo{Start: time.Now(), URL: o.URL}
+	}
 	client, _ := fhttp.NewClient(o)
 	// big gotcha that nil client isn't nil interface value (!)
 	if client == nil || reflect.ValueOf(client).IsNil() {
@@ -157,19 +298,47 @@ func FetchURL(o *fhttp.HTTPOptions) {
 		code, data, headerI = client.Fetch(context.Background())
 		dataLen = int64(len(data))
 		header = uint(headerI)
-		if *curlHeadersStdout {
-			os.Stdout.Write(data)
-		} else {
-			os.Stderr.Write(data[:header])
-			os.Stdout.Write(data[header:])
+		_, err := headerOut.Write(data[:header])
+		if err == nil {
+			_, err = bodyOut.Write(data[header:])
+		}
+		if err != nil {
+			log.Errf("Unable to write response: %v", err)
+			os.Exit(ExitWriteError)
 		}
 	} else {
 		code, dataLen, header = client.StreamFetch(context.Background())
 	}
+	closeOutput(bodyOut)
+	closeOutput(headerOut)
 	log.LogVf("Fetch result code %d, data len %d, headerlen %d", code, dataLen, header)
-	if code != http.StatusOK {
+	if o.FetchInfo != nil {
+		os.Stdout.WriteString(o.FetchInfo.WriteOut(writeOut))
+	}
+	if exitCode := fetchExitCode(code, *failFlag); exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// fetchExitCode returns the exit code for the status of the fetch: 0 for 200, otherwise 1 or,
+// when fail (like curl -f), 0 for status below 400, 22 above and 7 for connection/socket errors.
+func fetchExitCode(code int, fail bool) int {
+	if !fail {
+		if code != http.StatusOK {
+			log.Errf("Error status %d", code)
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case code < 0:
+		log.Errf("Connection error %d", code)
+		return ExitConnectError
+	case code >= http.StatusBadRequest:
 		log.Errf("Error status %d", code)
-		os.Exit(1)
+		return ExitHTTPError
+	default:
+		return 0
 	}
 }
 
@@ -199,15 +368,25 @@ func SharedHTTPOptions() *fhttp.HTTPOptions {
 	httpOpts.URL = url
 	httpOpts.HTTP10 = *http10Flag
 	httpOpts.H2 = *h2Flag
+	httpOpts.FastH2 = *h2FastFlag
+	httpOpts.H2Streams = *h2StreamsFlag
+	httpOpts.Pipeline = *pipelineFlag
 	httpOpts.DisableFastClient = *stdClientFlag
 	httpOpts.DisableKeepAlive = !*keepAliveFlag
 	httpOpts.AllowHalfClose = *halfCloseFlag
 	httpOpts.Compression = *compressionFlag
+	httpOpts.Decompress = *decompressFlag
 	httpOpts.HTTPReqTimeOut = *httpReqTimeoutFlag
 	httpOpts.Insecure = TLSInsecure()
 	httpOpts.Resolve = *resolve
+	httpOpts.Proxy = *proxyFlag
+	httpOpts.SourceAddress = *sourceAddrFlag
 	httpOpts.UserCredentials = *userCredentialsFlag
 	httpOpts.ContentType = *contentTypeFlag
+	httpOpts.MethodOverride = strings.ToUpper(strings.TrimSpace(*methodFlag))
+	if *headOnlyFlag {
+		httpOpts.MethodOverride = http.MethodHead
+	}
 	if *PayloadStreamFlag {
 		httpOpts.PayloadReader = os.Stdin
 	} else {
@@ -227,8 +406,57 @@ func SharedHTTPOptions() *fhttp.HTTPOptions {
 	httpOpts.Cert = *CertFlag
 	httpOpts.Key = *KeyFlag
 	httpOpts.MTLS = *mTLS
+	httpOpts.MinVersion = *tlsMinFlag
+	httpOpts.MaxVersion = *tlsMaxFlag
+	httpOpts.CipherSuites = commaList(*tlsCiphersFlag)
+	httpOpts.Curves = commaList(*tlsCurvesFlag)
+	httpOpts.ServerName = *sniFlag
+	httpOpts.ALPN = commaList(*alpnFlag)
+	httpOpts.Resumption = *tlsResumptionFlag
 	httpOpts.LogErrors = *LogErrorsFlag
 	httpOpts.SequentialWarmup = *warmupFlag
 	httpOpts.NoResolveEachConn = *NoReResolveFlag
+	httpOpts.Validation = responseValidation()
+	httpOpts.Cookies = *cookiesFlag
+	if *loginFlag != "" {
+		httpOpts.Login = &fhttp.LoginRequest{URL: *loginFlag, Payload: *loginPayloadFlag, TokenPath: *loginTokenFlag}
+	}
+	var err error
+	httpOpts.Retry, err = fhttp.NewRetryPolicy(*retriesFlag, *retryOnFlag, *retryBackoffFlag, *retryMaxBackoffFlag)
+	if err != nil {
+		log.Errf("Invalid -retry-on %q: %v", *retryOnFlag, err)
+		os.Exit(1)
+	}
 	return &httpOpts
 }
+
+// responseValidation returns the response checks from the -expect-* flags, nil if none.
+func responseValidation() *fhttp.ResponseValidation {
+	v := fhttp.ResponseValidation{
+		BodyContains: *expectBodyFlag,
+		BodyRegex:    *expectRegexFlag,
+		Size:         *expectSizeFlag,
+		Checksum:     *expectSHA256Flag,
+		Headers:      expectHeaders,
+	}
+	v.JSONPath, v.JSONValue, _ = strings.Cut(*expectJSONFlag, "=")
+	if *expectStatusFlag != "" {
+		for _, s := range strings.Split(*expectStatusFlag, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				log.Errf("Invalid -expect-status %q: %v", *expectStatusFlag, err)
+				os.Exit(1)
+			}
+			v.Status = append(v.Status, code)
+		}
+	}
+	if len(v.Status) == 0 && v.BodyContains == "" && v.BodyRegex == "" && v.JSONPath == "" &&
+		v.Size == 0 && v.Checksum == "" && len(v.Headers) == 0 {
+		return nil
+	}
+	if err := v.Init(); err != nil {
+		log.Errf("Invalid response validation flags: %v", err)
+		os.Exit(1)
+	}
+	return &v
+}
@@ -36,11 +36,13 @@ import (
 	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/sserunner"
 	"fortio.org/fortio/stats"
 	"fortio.org/fortio/tcprunner"
 	"fortio.org/fortio/udprunner"
 	"fortio.org/fortio/ui"
 	"fortio.org/fortio/version"
+	"fortio.org/fortio/wsrunner"
 	"fortio.org/log"
 	"fortio.org/scli"
 )
@@ -75,7 +77,7 @@ func (f *httpMultiFlagList) Set(value string) error {
 
 // fortio's help/args message.
 func helpArgsString() string {
-	return fmt.Sprintf("target\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s",
+	return fmt.Sprintf("target\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s",
 		"where command is one of: load (load testing), server (starts ui, rest api,",
 		" http-echo, redirect, proxies, tcp-echo, udp-echo and grpc ping servers), ",
 		" tcp-echo (only the tcp-echo server), udp-echo (only udp-echo server),",
@@ -84,7 +86,8 @@ func helpArgsString() string {
 		" or curl (single URL debug), or nc (single tcp or udp:// connection),",
 		" or version (prints the full version and build details).",
 		"where target is a url (http load tests) or host:port (grpc health test),",
-		" or tcp://host:port (tcp load test), or udp://host:port (udp load test).")
+		" or tcp://host:port (tcp load test), or udp://host:port (udp load test),",
+		" or ws://host:port/path or wss:// (websocket messages load test).")
 }
 
 // Attention: every flag that is common to http client goes to bincommon/
@@ -106,7 +109,11 @@ var (
 	goMaxProcsFlag  = flag.Int("gomaxprocs", 0, "Setting for runtime.GOMAXPROCS, <1 doesn't change the default")
 	profileFlag     = flag.String("profile", "", "write .cpu and .mem profiles to `file`")
 	grpcFlag        = flag.Bool("grpc", false, "Use GRPC (health check by default, add -ping for ping) for load testing")
-	echoPortFlag    = flag.String("http-port", "8080",
+	sseFlag         = flag.Bool("sse", false,
+		"Consume Server-Sent Events streams (one per connection, -qps is ignored) instead of http requests for load testing")
+	sseTimestampFlag = flag.String("sse-timestamp", "ts",
+		"Name of the json data `field` holding the events timestamp, for the -sse delivery latency")
+	echoPortFlag = flag.String("http-port", "8080",
 		"http echo server port. Can be in the form of host:port, ip:port, `port` or /unix/domain/path or \""+disabled+"\".")
 	tcpPortFlag = flag.String("tcp-port", "8078",
 		"tcp echo server port. Can be in the form of host:port, ip:port, `port` or /unix/domain/path or \""+disabled+"\".")
@@ -178,6 +185,12 @@ var (
 	accessLogFileFormat = flag.String("access-log-format", "json",
 		"`format` for access log. Supported values: [json, influx]")
 	calcQPS = flag.Bool("calc-qps", false, "Calculate the qps based on number of requests (-n) and duration (-t)")
+
+	replayFlag = flag.String("replay", "",
+		"JSONL or HAR `file` of requests to replay (in a loop) instead of just the url, which is then the base for relative urls")
+	replayShuffleFlag = flag.Bool("replay-shuffle", false, "Shuffle the order of the -replay requests")
+	replaySpeedFlag   = flag.Float64("replay-speed", 0,
+		"When > 0, send the -replay requests at their original timing sped up by this `factor`, instead of at -qps")
 )
 
 // serverArgCheck always returns true after checking arguments length.
@@ -437,9 +450,21 @@ func fortioLoad(justCurl bool, percList []float64, hook bincommon.FortioHook) {
 			Delay:              *pingDelayFlag,
 			UsePing:            *doPingLoadFlag,
 			Metadata:           httpHeader2grpcMetadata(httpOpts.AllHeaders()),
+			SourceAddress:      httpOpts.SourceAddress,
+			Retry:              httpOpts.Retry,
 		}
 		o.TLSOptions = httpOpts.TLSOptions
 		res, err = fgrpc.RunGRPCTest(&o)
+	} else if *sseFlag {
+		o := sserunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Headers = httpOpts.AllHeaders()
+		o.TimestampField = *sseTimestampFlag
+		o.TLSOptions = httpOpts.TLSOptions
+		res, err = sserunner.RunSSETest(&o)
 	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) {
 		o := tcprunner.RunnerOptions{
 			RunnerOptions: ro,
@@ -447,6 +472,7 @@ func fortioLoad(justCurl bool, percList []float64, hook bincommon.FortioHook) {
 		o.ReqTimeout = httpOpts.HTTPReqTimeOut
 		o.Destination = url
 		o.Payload = httpOpts.Payload
+		o.SourceAddress = httpOpts.SourceAddress
 		res, err = tcprunner.RunTCPTest(&o)
 	} else if strings.HasPrefix(url, udprunner.UDPURLPrefix) {
 		o := udprunner.RunnerOptions{
@@ -455,7 +481,18 @@ func fortioLoad(justCurl bool, percList []float64, hook bincommon.FortioHook) {
 		o.ReqTimeout = *udpTimeoutFlag
 		o.Destination = url
 		o.Payload = httpOpts.Payload
+		o.SourceAddress = httpOpts.SourceAddress
 		res, err = udprunner.RunUDPTest(&o)
+	} else if wsrunner.IsWebSocketURL(url) {
+		o := wsrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpOpts.Payload
+		o.Headers = httpOpts.AllHeaders()
+		o.TLSOptions = httpOpts.TLSOptions
+		res, err = wsrunner.RunWSTest(&o)
 	} else {
 		o := fhttp.HTTPRunnerOptions{
 			HTTPOptions:        *httpOpts,
@@ -463,6 +500,15 @@ func fortioLoad(justCurl bool, percList []float64, hook bincommon.FortioHook) {
 			Profiler:           *profileFlag,
 			AllowInitialErrors: *allowInitialErrorsFlag,
 			AbortOn:            *abortOnFlag,
+			ReplayShuffle:      *replayShuffleFlag,
+			ReplaySpeed:        *replaySpeedFlag,
+		}
+		if *replayFlag != "" {
+			o.Replay, err = fhttp.ReadReplayFile(*replayFlag)
+			if err != nil {
+				// Error already logged.
+				os.Exit(1)
+			}
 		}
 		res, err = fhttp.RunHTTPTest(&o)
 	}
@@ -472,7 +518,7 @@ func fortioLoad(justCurl bool, percList []float64, hook bincommon.FortioHook) {
 	}
 	rr := res.Result()
 	warmup := *numThreadsFlag
-	if ro.Exactly > 0 {
+	if ro.Exactly > 0 || *sseFlag {
 		warmup = 0
 	}
 	_, _ = fmt.Fprintf(out, "All done %d calls (plus %d warmup) %.3f ms avg, %.1f qps\n",
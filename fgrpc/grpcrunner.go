@@ -33,6 +33,7 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
 )
 
 // Dial dials grpc using insecure or tls transport security when serverAddr
@@ -45,7 +46,9 @@ func Dial(o *GRPCRunnerOptions) (*grpc.ClientConn, error) {
 		if err != nil {
 			return nil, err
 		}
-		tlsConfig.ServerName = o.CertOverride
+		if o.CertOverride != "" {
+			tlsConfig.ServerName = o.CertOverride
+		}
 		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
@@ -56,6 +59,14 @@ func Dial(o *GRPCRunnerOptions) (*grpc.ClientConn, error) {
 		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
 			return net.Dial(fnet.UnixDomainSocket, o.UnixDomainSocket)
 		}))
+	} else if o.SourceAddress != "" {
+		source, err := fnet.GetSourceAddress(o.SourceAddress)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return source.DialContext(ctx, &net.Dialer{}, "tcp", addr)
+		}))
 	}
 	opts = append(opts, o.dialOptions...)
 	conn, err := grpc.Dial(serverAddr, opts...)
@@ -80,6 +91,9 @@ type GRPCRunnerResults struct {
 	Streams     int
 	Ping        bool
 	Metadata    metadata.MD
+	// Retry accounting, when the Retry policy is enabled.
+	Retries *fhttp.RetryResults `json:",omitempty"`
+	retry   *fhttp.RetryPolicy
 }
 
 // Run exercises GRPC health check or ping at the target QPS.
@@ -92,17 +106,28 @@ func (grpcstate *GRPCRunnerResults) Run(outCtx context.Context, t periodic.Threa
 	if len(grpcstate.Metadata) != 0 { // filtered one
 		outCtx = metadata.NewOutgoingContext(outCtx, grpcstate.Metadata)
 	}
-	if grpcstate.Ping {
-		res, err = grpcstate.clientP.Ping(outCtx, &grpcstate.reqP)
-	} else {
-		var r *grpc_health_v1.HealthCheckResponse
-		r, err = grpcstate.clientH.Check(outCtx, &grpcstate.reqH)
-		if r != nil {
-			status = r.Status
-			res = r
+	attempts := 1
+	for {
+		if grpcstate.Ping {
+			res, err = grpcstate.clientP.Ping(outCtx, &grpcstate.reqP)
+		} else {
+			var r *grpc_health_v1.HealthCheckResponse
+			r, err = grpcstate.clientH.Check(outCtx, &grpcstate.reqH)
+			if r != nil {
+				status = r.Status
+				res = r
+			}
 		}
+		if err == nil || !grpcstate.shouldRetry(attempts, err) || !grpcstate.retry.Wait(outCtx, attempts) {
+			break
+		}
+		log.Debugf("Retrying after attempt %d got %v", attempts, err)
+		attempts++
 	}
 	log.Debugf("For %d (ping=%v) got %v %v", t, grpcstate.Ping, err, res)
+	if grpcstate.Retries != nil {
+		grpcstate.Retries.Record(attempts, err == nil && status == grpc_health_v1.HealthCheckResponse_SERVING)
+	}
 	if err != nil {
 		log.Warnf("Error making grpc call: %v", err)
 		grpcstate.RetCodes[Error]++
@@ -115,6 +140,12 @@ func (grpcstate *GRPCRunnerResults) Run(outCtx context.Context, t periodic.Threa
 	return false, status.String()
 }
 
+// shouldRetry checks the error's grpc status code, or -1 for any error, against the retry policy.
+func (grpcstate *GRPCRunnerResults) shouldRetry(attempt int, err error) bool {
+	return grpcstate.retry.ShouldRetry(attempt, int(grpcstatus.Code(err))) ||
+		grpcstate.retry.ShouldRetry(attempt, fhttp.SocketError)
+}
+
 // GRPCRunnerOptions includes the base RunnerOptions plus grpc specific
 // options.
 type GRPCRunnerOptions struct {
@@ -130,8 +161,12 @@ type GRPCRunnerOptions struct {
 	AllowInitialErrors bool              // whether initial errors don't cause an abort
 	UsePing            bool              // use our own Ping proto for grpc load instead of standard health check one.
 	Metadata           metadata.MD       // input metadata that will be added to the request
+	SourceAddress      string            // optional local ips (and port range) to bind to, see fnet.GetSourceAddress()
 	dialOptions        []grpc.DialOption // grpc dial options extracted from Metadata (authority and user-agent extracted)
 	filteredMetadata   metadata.MD       // filtered version of Metadata metadata (without authority and user-agent)
+
+	// Optional retries, on grpc status codes (-1 for any error).
+	Retry *fhttp.RetryPolicy
 }
 
 // RunGRPCTest runs an http test and returns the aggregated stats.
@@ -170,6 +205,10 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 		Ping:        o.UsePing,
 		Metadata:    o.Metadata, // the original one
 	}
+	if o.Retry.Enabled() {
+		total.retry = o.Retry
+		total.Retries = &fhttp.RetryResults{}
+	}
 	grpcstate := make([]GRPCRunnerResults, numThreads)
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
 	var conn *grpc.ClientConn
@@ -218,6 +257,10 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 		}
 		// Setup the stats for each 'thread'
 		grpcstate[i].RetCodes = make(HealthResultMap)
+		if total.retry != nil {
+			grpcstate[i].retry = total.retry
+			grpcstate[i].Retries = &fhttp.RetryResults{}
+		}
 	}
 
 	if o.Profiler != "" {
@@ -256,6 +299,9 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 			}
 			total.RetCodes[k] += grpcstate[i].RetCodes[k]
 		}
+		if total.Retries != nil {
+			total.Retries.Add(grpcstate[i].Retries)
+		}
 		// TODO: if grpc client needs 'cleanup'/Close like http one, do it on original NumThreads
 	}
 	// Cleanup state:
@@ -268,6 +314,9 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 	for _, k := range keys {
 		_, _ = fmt.Fprintf(out, "%s %s : %d\n", which, k, total.RetCodes[k])
 	}
+	if total.Retries != nil {
+		total.Retries.Print(out, total.DurationHistogram.Count)
+	}
 	return &total, nil
 }
 
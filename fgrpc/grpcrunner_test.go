@@ -447,6 +447,45 @@ func (m *mdTestServer) Serve() *net.TCPAddr {
 	return lis.Addr().(*net.TCPAddr)
 }
 
+func TestGRPCRunnerRetries(t *testing.T) {
+	port := PingServerTCP("0", "bar", 0, noTLSO)
+	tests := []struct {
+		codes    string
+		attempts int64
+		failures int64
+	}{
+		{"5", 15, 5}, // NotFound for the unknown service: retried
+		{"socket", 15, 5},
+		{"14", 5, 0}, // Unavailable: not retried
+	}
+	for _, test := range tests {
+		retry, err := fhttp.NewRetryPolicy(2, test.codes, 0, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		o := GRPCRunnerOptions{
+			Destination:        fmt.Sprintf("localhost:%d", port),
+			Service:            "svc2",
+			AllowInitialErrors: true,
+			Retry:              retry,
+		}
+		o.QPS = -1
+		o.Exactly = 5
+		o.NumThreads = 1
+		res, err := RunGRPCTest(&o)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		r := res.Retries
+		if r == nil || r.Attempts != test.attempts || r.FinalFailures != test.failures || r.RetriedSuccesses != 0 {
+			t.Errorf("Retry on %s: unexpected retry results %+v", test.codes, r)
+		}
+		if res.RetCodes[Error] != 5 {
+			t.Errorf("Retry on %s: unexpected codes %v", test.codes, res.RetCodes)
+		}
+	}
+}
+
 func TestGRPCRunnerWithMetadata(t *testing.T) {
 	server := &mdTestServer{t: t}
 	addr := server.Serve()
@@ -32,6 +32,8 @@ import (
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
+	grpcstats "google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -87,6 +89,7 @@ func PingServer(port, healthServiceName string, maxConcurrentStreams uint32, tls
 		log.Printf("Using server cert and key from %v and %v to construct %sTLS credentials", tlsOptions.Cert, tlsOptions.Key, mtls)
 		grpcOptions = append(grpcOptions, grpc.Creds(creds))
 	}
+	grpcOptions = append(grpcOptions, grpc.StatsHandler(metricsHandler{server: "grpc-ping"}))
 	grpcServer := grpc.NewServer(grpcOptions...)
 	reflection.Register(grpcServer)
 	healthServer := health.NewServer()
@@ -102,6 +105,53 @@ func PingServer(port, healthServiceName string, maxConcurrentStreams uint32, tls
 	return addr
 }
 
+// metricsHandler is the grpc stats.Handler recording the ping server's requests and connections
+// in the fhttp server metrics.
+type metricsHandler struct {
+	server string
+}
+
+type rpcInfoKey struct{}
+
+// rpcInfo is the method and payload bytes of an ongoing rpc.
+type rpcInfo struct {
+	method  string
+	in, out int64
+}
+
+func (h metricsHandler) TagRPC(ctx context.Context, info *grpcstats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, rpcInfoKey{}, &rpcInfo{method: info.FullMethodName})
+}
+
+func (h metricsHandler) HandleRPC(ctx context.Context, s grpcstats.RPCStats) {
+	ri, _ := ctx.Value(rpcInfoKey{}).(*rpcInfo)
+	if ri == nil {
+		return
+	}
+	switch st := s.(type) {
+	case *grpcstats.InPayload:
+		ri.in += int64(st.WireLength)
+	case *grpcstats.OutPayload:
+		ri.out += int64(st.WireLength)
+	case *grpcstats.End:
+		fhttp.RecordServerRequest(h.server, "grpc", ri.method, status.Code(st.Error).String(),
+			st.EndTime.Sub(st.BeginTime), ri.in, ri.out)
+	}
+}
+
+func (h metricsHandler) TagConn(ctx context.Context, _ *grpcstats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h metricsHandler) HandleConn(_ context.Context, s grpcstats.ConnStats) {
+	switch s.(type) {
+	case *grpcstats.ConnBegin:
+		fhttp.RecordServerConnection(h.server, 1)
+	case *grpcstats.ConnEnd:
+		fhttp.RecordServerConnection(h.server, -1)
+	}
+}
+
 // PingServerTCP is PingServer() assuming tcp instead of possible unix domain socket port, returns
 // the numeric port.
 func PingServerTCP(port, healthServiceName string, maxConcurrentStreams uint32, tlsOptions *fhttp.TLSOptions) int {
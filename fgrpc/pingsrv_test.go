@@ -18,6 +18,7 @@ package fgrpc
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -125,6 +126,28 @@ func TestDefaultHealth(t *testing.T) {
 	}
 }
 
+func TestPingServerMetrics(t *testing.T) {
+	_ = fhttp.ServerMetrics.Set("true")
+	defer func() { _ = fhttp.ServerMetrics.Set("false") }()
+	iPort := PingServerTCP("0", "", 0, noTLSO)
+	iAddr := fmt.Sprintf("localhost:%d", iPort)
+	if _, err := PingClientCall(iAddr, 3, "abc", 0, &fhttp.TLSOptions{Insecure: true}, nil); err != nil {
+		t.Fatalf("Unexpected ping error %v", err)
+	}
+	var b strings.Builder
+	fhttp.WriteServerMetrics(&b)
+	m := b.String()
+	for _, s := range []string{
+		`fortio_server_requests_total{server="grpc-ping",method="grpc",path="/fgrpc.PingServer/Ping",status="OK"} `,
+		`fortio_server_request_duration_seconds_count{server="grpc-ping",path="/fgrpc.PingServer/Ping"} `,
+		`fortio_server_received_bytes_total{server="grpc-ping"} `,
+	} {
+		if !strings.Contains(m, s) {
+			t.Errorf("Missing %s in metrics:\n%s", s, m)
+		}
+	}
+}
+
 func TestSettingMetadata(t *testing.T) {
 	server := &mdTestServer{}
 	addr := server.Serve()
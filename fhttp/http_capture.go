@@ -0,0 +1,236 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Echo server requests capture (last N per path) and inspection endpoint.
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/dflag"
+	"fortio.org/fortio/jrpc"
+	"fortio.org/log"
+)
+
+// EchoCaptureSize is the number of requests the echo server keeps, per path, for the
+// CaptureHandler. 0 (the default) disables the capture.
+var EchoCaptureSize = dflag.New(int64(0),
+	"Number of `requests` to keep per path for the echo server requests capture endpoint, 0 to disable. dynamic flag.")
+
+// CaptureBodySize is the maximum number of bytes of the request body kept in the captures.
+var CaptureBodySize = 256
+
+// MaxCapturePaths is the maximum number of distinct paths captured, requests to further paths aren't.
+var MaxCapturePaths = 1000
+
+// CapturedRequest is what is kept about each captured echo request.
+type CapturedRequest struct {
+	Time       time.Time
+	Method     string
+	URL        string
+	Proto      string
+	Host       string
+	RemoteAddr string
+	Headers    http.Header
+	// Request body size and its first CaptureBodySize bytes, escaped (see DebugSummary).
+	BodySize int64
+	Body     string
+	// Response status (0 for faults) and handling time.
+	Status   int
+	Duration time.Duration
+}
+
+// captureRing is the last size captures of a path.
+type captureRing struct {
+	entries []*CapturedRequest
+	next    int
+}
+
+var (
+	captureMutex sync.Mutex
+	captures     = make(map[string]*captureRing) // path -> captures
+)
+
+// ResetCaptures clears all the captured requests.
+func ResetCaptures() {
+	captureMutex.Lock()
+	captures = make(map[string]*captureRing)
+	captureMutex.Unlock()
+}
+
+func storeCapture(path string, c *CapturedRequest) {
+	size := int(EchoCaptureSize.Get())
+	if size <= 0 { // capture turned off while the request was handled
+		return
+	}
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+	ring := captures[path]
+	if ring == nil || cap(ring.entries) != size { // new path or size changed: start over
+		if ring == nil && len(captures) >= MaxCapturePaths {
+			return
+		}
+		ring = &captureRing{entries: make([]*CapturedRequest, 0, size)}
+		captures[path] = ring
+	}
+	if len(ring.entries) < size {
+		ring.entries = append(ring.entries, c)
+		return
+	}
+	ring.entries[ring.next] = c
+	ring.next = (ring.next + 1) % size
+}
+
+// captureReader keeps the size and first CaptureBodySize bytes of the body.
+type captureReader struct {
+	io.ReadCloser
+	n    int64
+	head []byte
+}
+
+func (r *captureReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	if keep := CaptureBodySize - len(r.head); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+		r.head = append(r.head, b[:keep]...)
+	}
+	return n, err
+}
+
+// requestCapture captures a request and its response status while it's being handled.
+type requestCapture struct {
+	metricsResponseWriter
+	r     *http.Request
+	body  *captureReader
+	start time.Time
+}
+
+// startCapture returns the capture of the request, nil if the capture is disabled.
+// The request and response writer to use are in the returned capture.
+func startCapture(w http.ResponseWriter, r *http.Request) *requestCapture {
+	if EchoCaptureSize.Get() <= 0 {
+		return nil
+	}
+	c := &requestCapture{metricsResponseWriter: metricsResponseWriter{ResponseWriter: w}, start: time.Now()}
+	c.body = &captureReader{ReadCloser: r.Body}
+	nr := *r
+	nr.Body = c.body
+	c.r = &nr
+	return c
+}
+
+func (c *requestCapture) done() {
+	status := c.status
+	if status == 0 && !c.hijacked {
+		status = http.StatusOK
+	}
+	r := c.r
+	storeCapture(r.URL.Path, &CapturedRequest{
+		Time:       c.start,
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Proto:      r.Proto,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Headers:    r.Header.Clone(),
+		BodySize:   c.body.n,
+		Body:       DebugSummary(c.body.head, CaptureBodySize),
+		Status:     status,
+		Duration:   time.Since(c.start),
+	})
+}
+
+// CapturePath returns the path of the requests capture endpoint for debugPath.
+func CapturePath(debugPath string) string {
+	return strings.TrimSuffix(debugPath, "/") + "/requests"
+}
+
+// matches returns true if the capture matches the path (prefix), method, header
+// (name:value substring) and since (time) filters of the CaptureHandler.
+func (c *CapturedRequest) matches(path, method, header string, since time.Time) bool {
+	if !strings.HasPrefix(c.URL, path) {
+		return false
+	}
+	if method != "" && !strings.EqualFold(c.Method, method) {
+		return false
+	}
+	if header != "" {
+		name, value, _ := strings.Cut(header, ":")
+		found := false
+		for _, v := range c.Headers.Values(name) {
+			if strings.Contains(v, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return !c.Time.Before(since)
+}
+
+// CaptureHandler replies with the json list, oldest first, of the captured echo requests,
+// filtered by the path (prefix), method, header (name:value substring), since (RFC3339 time)
+// and limit (last N) query arguments. clear=true empties the captures.
+func CaptureHandler(w http.ResponseWriter, r *http.Request) {
+	log.LogRequest(r, "Requests capture")
+	if QueryArg(r, "clear") == "true" {
+		ResetCaptures()
+		_ = jrpc.ReplyOk(w, &[]*CapturedRequest{})
+		return
+	}
+	var since time.Time
+	if s := QueryArg(r, "since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			_ = jrpc.ReplyError(w, "invalid since time", err)
+			return
+		}
+	}
+	limit := 0
+	if l := QueryArg(r, "limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			_ = jrpc.ReplyError(w, "invalid limit", err)
+			return
+		}
+	}
+	path, method, header := QueryArg(r, "path"), QueryArg(r, "method"), QueryArg(r, "header")
+	res := []*CapturedRequest{}
+	captureMutex.Lock()
+	for _, ring := range captures {
+		for _, c := range ring.entries {
+			if c.matches(path, method, header, since) {
+				res = append(res, c)
+			}
+		}
+	}
+	captureMutex.Unlock()
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	if limit > 0 && len(res) > limit {
+		res = res[len(res)-limit:]
+	}
+	_ = jrpc.ReplyOk(w, &res)
+}
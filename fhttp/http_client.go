@@ -38,6 +38,7 @@ import (
 	"fortio.org/log"
 	"github.com/google/uuid"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 // Fetcher is the Url content fetcher that the different client implements.
@@ -59,10 +60,6 @@ type Fetcher interface {
 	GetIPAddress() (*stats.Occurrence, *stats.Histogram)
 }
 
-const (
-	uuidToken = "{uuid}"
-)
-
 var (
 	// BufferSizeKb size of the buffer (max data) for optimized client in kilobytes defaults to 128k.
 	BufferSizeKb = 128
@@ -153,8 +150,12 @@ func (h *HTTPOptions) URLSchemeCheck() {
 		log.Infof("PayloadReader set, switching to H2")
 		h.H2 = true
 	}
-	if h.H2 && !h.DisableFastClient {
-		log.Infof("H2 requested, switching to std client")
+	if h.PayloadReader != nil && !h.DisableFastClient {
+		log.Infof("PayloadReader set, switching to std client")
+		h.DisableFastClient = true
+	}
+	if h.H2 && !h.FastH2 && !h.DisableFastClient {
+		log.Infof("H2 requested, switching to std client (use -h2-fast for the fast client)")
 		h.DisableFastClient = true
 	}
 	hs := "https://" // longer of the 2 prefixes
@@ -183,10 +184,13 @@ type HTTPOptions struct {
 	TLSOptions
 	URL               string
 	NumConnections    int  // num connections (for std client)
-	Compression       bool // defaults to no compression, only used by std client
+	Compression       bool // defaults to no compression, the fast client then only requests it (see Decompress)
 	DisableFastClient bool // defaults to fast client
 	HTTP10            bool // defaults to http1.1
-	H2                bool // defaults to http1.1 (h2 only for stdclient)
+	H2                bool // defaults to http1.1
+	FastH2            bool // use the fast client for h2 (defaults to switching to the std client)
+	H2Streams         int  // fast client h2: number of clients (threads) sharing each connection, ie max concurrent streams
+	Pipeline          int  // fast client http/1.1 keepalive: number of requests written back to back before reading the responses
 	DisableKeepAlive  bool // so default is keep alive
 	AllowHalfClose    bool // if not keepalive, whether to half close after request
 	FollowRedirects   bool // For the Std Client only: follow redirects.
@@ -200,6 +204,7 @@ type HTTPOptions struct {
 	HTTPReqTimeOut   time.Duration // timeout value for http request
 	UserCredentials  string        // user credentials for authorization
 	ContentType      string        // indicates request body type, implies POST instead of GET
+	MethodOverride   string        // when set, the http method to use instead of the GET/POST default
 	Payload          []byte        // body for http request, implies POST if not empty.
 	LogErrors        bool          // whether to log non 2xx code as they occur or not
 	ID               int           `json:"-"` // thread/connect id to use for logging (thread id when used as a runner)
@@ -217,9 +222,33 @@ type HTTPOptions struct {
 	// Optional Transport chain factory to use if set. Only effective when using std client.
 	// pass otelhttp.NewTransport for instance.
 	Transport CreateTransport `json:"-"`
+	// Optional proxy url: http://[user:password@]host:port (CONNECT tunnel for https, absolute-form
+	// requests for http) or socks5://[user:password@]host:port.
+	Proxy string `json:",omitempty"`
+	// Optional local ips (and port range) to bind the connections to, see fnet.GetSourceAddress().
+	SourceAddress string `json:",omitempty"`
+	// Set by the runner to share h2 connections between fast clients (H2Streams > 1).
+	h2Groups *h2Groups
+	// Optional checks on each response of a run (the runner calls Init()).
+	Validation *ResponseValidation `json:",omitempty"`
+	// Optional retries of failed calls done by the runners.
+	Retry *RetryPolicy `json:",omitempty"`
+	// Fast client: decode the compressed responses (implies Compression), for validation and decoded sizes.
+	Decompress bool `json:",omitempty"`
+	// Keep the cookies received by each client and send them back in its next requests.
+	Cookies bool `json:",omitempty"`
+	// Optional request done once by each client before the others to start a session, implies Cookies.
+	Login *LoginRequest `json:",omitempty"`
+	// Set for the login client, to share the cookie jar.
+	jar http.CookieJar
 	// These following 2 options are only making sense for single operation (curl) mode.
 	PayloadReader io.Reader `json:"-"` // if set, Payload is ignored and this is used instead.
 	DataWriter    io.Writer `json:"-"` // if set, the response body is written to this writer.
+	// Also for curl mode: if set, filled with the timings and details of the fetch (write-out).
+	FetchInfo *FetchInfo `json:"-"`
+	// Std client: if set, the response status line and headers are written to it (the fast
+	// client's DataWriter gets them before the body).
+	HeaderWriter io.Writer `json:"-"`
 }
 
 type CreateClientTrace func(ctx context.Context) *httptrace.ClientTrace
@@ -285,8 +314,12 @@ func (h *HTTPOptions) AllHeaders() http.Header {
 	return headers
 }
 
-// Method returns the method of the http req.
+// Method returns the method of the http req: MethodOverride if set, otherwise
+// POST when there is a payload or content type and GET if not.
 func (h *HTTPOptions) Method() string {
+	if h.MethodOverride != "" {
+		return h.MethodOverride
+	}
 	if len(h.Payload) > 0 || h.ContentType != "" {
 		return fnet.POST
 	}
@@ -401,23 +434,41 @@ func newHTTPRequest(o *HTTPOptions) (*http.Request, error) {
 // http client (net/http).
 // TODO: refactor common parts with FastClient.
 type Client struct {
-	url                  string
-	path                 string // original path of the request's url
-	rawQuery             string // original query params
-	body                 []byte // original body of the request
-	req                  *http.Request
-	client               *http.Client
-	transport            Transport
-	pathContainsUUID     bool // if url contains the "{uuid}" pattern (lowercase)
-	rawQueryContainsUUID bool // if any query params contains the "{uuid}" pattern (lowercase)
-	bodyContainsUUID     bool // if body contains the "{uuid}" pattern (lowercase)
-	logErrors            bool
-	id                   int
-	runID                int64
-	ipAddrUsage          *stats.Occurrence
-	connectStats         *stats.Histogram
-	clientTrace          CreateClientTrace
-	dataWriter           io.Writer
+	url       string
+	body      []byte // original body of the request
+	req       *http.Request
+	client    *http.Client
+	transport Transport
+	// Per request templates (nil when the corresponding part has no {token}), see http_template.go
+	pathTemplate     *requestTemplate
+	rawQueryTemplate *requestTemplate
+	bodyTemplate     *requestTemplate
+	headerTemplates  map[string]*requestTemplate
+	templateState    templateState
+	retry            bool // next requests are retries: resend the last rendered one
+	rendered         bool // rendered* are set
+	renderedURL      *url.URL
+	renderedHeader   http.Header
+	renderedBody     []byte
+	logErrors        bool
+	id               int
+	runID            int64
+	ipAddrUsage      *stats.Occurrence
+	connectStats     *stats.Histogram
+	proxyStats       *stats.Histogram // proxy connection and tunnel setup time, when using a proxy
+	tlsStats         *TLSStats        // handshakes, when using https
+	connStats        *connectionStats
+	lastConn         *trackedConn // connection of the last request
+	keepAlive        bool
+	info             *FetchInfo
+	source           *fnet.SourceAddress
+	clientTrace      CreateClientTrace
+	dataWriter       io.Writer
+	headerWriter     io.Writer
+	// Last response headers and body, kept for validation.
+	keepResponse bool
+	lastHeader   http.Header
+	lastBody     bytes.Buffer
 }
 
 func (c *Client) HasBuffer() bool {
@@ -458,40 +509,66 @@ func (c *Client) Fetch(ctx context.Context) (int, []byte, int) {
 	return status, buf.Bytes(), 0
 }
 
+// render renders the templates, if any, into the rendered* fields (which are otherwise
+// the url and headers of req).
+func (c *Client) render(req *http.Request) {
+	ts := &c.templateState
+	c.renderedURL, c.renderedHeader = req.URL, req.Header
+	if c.pathTemplate != nil || c.rawQueryTemplate != nil {
+		u := *req.URL // shallow copy above, don't change the shared URL
+		if c.pathTemplate != nil {
+			u.Path = c.pathTemplate.String(ts)
+		}
+		if c.rawQueryTemplate != nil {
+			u.RawQuery = c.rawQueryTemplate.String(ts)
+		}
+		c.renderedURL = &u
+	}
+	if len(c.headerTemplates) > 0 {
+		c.renderedHeader = c.req.Header.Clone()
+		for k, t := range c.headerTemplates {
+			c.renderedHeader.Set(k, t.String(ts))
+		}
+	}
+	if c.bodyTemplate != nil {
+		c.renderedBody = c.bodyTemplate.Append(nil, ts)
+	}
+	c.rendered = true
+	ts.seq++
+}
+
+// setRetry implements retrier.
+func (c *Client) setRetry(retry bool) {
+	c.retry = retry
+	if !retry {
+		c.rendered = false
+	}
+}
+
 // StreamFetch fetches the byte and code for pre created std client.
 // header length (3rd returned value) is always 0 for that client
 // and only available with the fastclient.
 func (c *Client) StreamFetch(ctx context.Context) (int, int64, uint) {
 	// req can't be null (client itself would be null in that case)
-	var req *http.Request
 	if c.clientTrace != nil {
-		req = c.req.WithContext(httptrace.WithClientTrace(ctx, c.clientTrace(ctx)))
-	} else {
-		req = c.req.WithContext(ctx)
+		ctx = httptrace.WithClientTrace(ctx, c.clientTrace(ctx))
 	}
-	if c.pathContainsUUID {
-		path := c.path
-		for strings.Contains(path, uuidToken) {
-			path = strings.Replace(path, uuidToken, generateUUID(), 1)
-		}
-		req.URL.Path = path
+	// Our traces are new for each request: WithClientTrace() adds the hooks of
+	// the ones already in ctx to them (it would grow a trace reused across requests).
+	if c.tlsStats != nil {
+		ctx = httptrace.WithClientTrace(ctx, c.tlsStats.clientTrace())
 	}
-	if c.rawQueryContainsUUID {
-		rawQuery := c.rawQuery
-		for strings.Contains(rawQuery, uuidToken) {
-			rawQuery = strings.Replace(rawQuery, uuidToken, generateUUID(), 1)
-		}
-
-		req.URL.RawQuery = rawQuery
+	if c.info != nil {
+		ctx = httptrace.WithClientTrace(ctx, c.info.clientTrace())
 	}
-	if c.bodyContainsUUID {
-		body := string(c.body)
-		for strings.Contains(body, uuidToken) {
-			body = strings.Replace(body, uuidToken, generateUUID(), 1)
-		}
-		bodyBytes := []byte(body)
-		req.ContentLength = int64(len(bodyBytes))
-		req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	req := c.req.WithContext(httptrace.WithClientTrace(ctx, c.connTrace()))
+	if !c.retry || !c.rendered {
+		c.render(req)
+	}
+	req.URL, req.Header = c.renderedURL, c.renderedHeader
+	if c.bodyTemplate != nil {
+		req.ContentLength = int64(len(c.renderedBody))
+		req.Body = io.NopCloser(bytes.NewReader(c.renderedBody))
 	} else if len(c.body) > 0 {
 		req.Body = io.NopCloser(bytes.NewReader(c.body))
 	}
@@ -500,8 +577,16 @@ func (c *Client) StreamFetch(ctx context.Context) (int, int64, uint) {
 		log.S(log.Error, "Unable to send request",
 			log.Attr("method", req.Method), log.Attr("url", c.url), log.Attr("err", err),
 			log.Attr("thread", c.id), log.Attr("run", c.runID))
+		c.info.finish(-1, 0, 0)
 		return -1, -1, 0
 	}
+	c.info.stdResponse(resp)
+	if resp.Close && c.keepAlive && c.lastConn != nil {
+		c.lastConn.closedByServer()
+	}
+	if c.headerWriter != nil {
+		writeResponseHeaders(c.headerWriter, resp)
+	}
 	var data []byte
 	if log.LogDebug() {
 		if data, err = httputil.DumpResponse(resp, false); err != nil {
@@ -513,8 +598,18 @@ func (c *Client) StreamFetch(ctx context.Context) (int, int64, uint) {
 	if c.dataWriter == nil {
 		c.dataWriter = io.Discard
 	}
+	w := c.dataWriter
+	if c.keepResponse {
+		c.lastHeader = resp.Header
+		c.lastBody.Reset()
+		if w == io.Discard {
+			w = &c.lastBody
+		} else {
+			w = io.MultiWriter(w, &c.lastBody)
+		}
+	}
 	var n int64
-	n, err = io.Copy(c.dataWriter, resp.Body)
+	n, err = io.Copy(w, resp.Body)
 	resp.Body.Close()
 	if err != nil {
 		log.S(log.Error, "Unable to read response",
@@ -524,6 +619,7 @@ func (c *Client) StreamFetch(ctx context.Context) (int, int64, uint) {
 			code = http.StatusNoContent
 			log.S(log.Warning, "Ok code despite read error, switching code to 204", log.Attr("thread", c.id), log.Attr("run", c.runID))
 		}
+		c.info.finish(code, 0, n)
 		return code, n, 0
 	}
 	code := resp.StatusCode
@@ -531,9 +627,42 @@ func (c *Client) StreamFetch(ctx context.Context) (int, int64, uint) {
 	if c.logErrors && !codeIsOK(code) {
 		log.S(log.Warning, "Non ok http code", log.Attr("code", code), log.Attr("thread", c.id), log.Attr("run", c.runID))
 	}
+	c.info.finish(code, 0, n)
 	return code, n, 0
 }
 
+// parseTemplates sets up the per request substitutions of the path, query, headers and body.
+func (c *Client) parseTemplates(o *HTTPOptions) error {
+	var err error
+	if c.pathTemplate, err = parseTemplate(c.req.URL.Path); err != nil {
+		return err
+	}
+	if c.rawQueryTemplate, err = parseTemplate(c.req.URL.RawQuery); err != nil {
+		return err
+	}
+	if o.PayloadReader == nil {
+		if c.bodyTemplate, err = parseTemplate(string(o.Payload)); err != nil {
+			return err
+		}
+	}
+	for k, v := range c.req.Header {
+		if len(v) != 1 {
+			continue // multi valued headers aren't templated
+		}
+		var t *requestTemplate
+		if t, err = parseTemplate(v[0]); err != nil {
+			return err
+		}
+		if t != nil {
+			if c.headerTemplates == nil {
+				c.headerTemplates = make(map[string]*requestTemplate)
+			}
+			c.headerTemplates[k] = t
+		}
+	}
+	return nil
+}
+
 // GetIPAddress get the ip address that DNS resolves to when using stdClient and connection stats.
 func (c *Client) GetIPAddress() (*stats.Occurrence, *stats.Histogram) {
 	return c.ipAddrUsage, c.connectStats
@@ -562,39 +691,78 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 	if req == nil {
 		return nil, err
 	}
+	jar, tokenHeader, token, err := o.session()
+	if err != nil {
+		return nil, err
+	}
+	if tokenHeader != "" {
+		req.Header.Set(tokenHeader, token)
+	}
 	client := Client{
-		url:                  o.URL,
-		path:                 req.URL.Path,
-		pathContainsUUID:     strings.Contains(req.URL.Path, uuidToken),
-		rawQuery:             req.URL.RawQuery,
-		rawQueryContainsUUID: strings.Contains(req.URL.RawQuery, uuidToken),
-		body:                 o.Payload,
-		bodyContainsUUID:     strings.Contains(string(o.Payload), uuidToken),
-		req:                  req,
+		url:  o.URL,
+		body: o.Payload,
+		req:  req,
 		client: &http.Client{
 			Timeout: o.HTTPReqTimeOut,
+			Jar:     jar,
 		},
 		id:          o.ID,
 		logErrors:   o.LogErrors,
 		ipAddrUsage: stats.NewOccurrence(),
 		// Keep track of timing for connection (re)establishment.
-		connectStats: stats.NewHistogram(o.Offset.Seconds(), o.Resolution),
-		clientTrace:  o.ClientTrace,
-		dataWriter:   o.DataWriter,
-		runID:        o.UniqueID,
+		connectStats:  stats.NewHistogram(o.Offset.Seconds(), o.Resolution),
+		clientTrace:   o.ClientTrace,
+		connStats:     newConnectionStats(o.Resolution),
+		keepAlive:     !o.DisableKeepAlive,
+		info:          o.FetchInfo,
+		dataWriter:    o.DataWriter,
+		headerWriter:  o.HeaderWriter,
+		runID:         o.UniqueID,
+		templateState: templateState{thread: o.ID, runID: o.UniqueID},
+		keepResponse:  o.Validation != nil,
+	}
+	if err = client.parseTemplates(o); err != nil {
+		return nil, err
 	}
+	if client.source, err = fnet.GetSourceAddress(o.SourceAddress); err != nil {
+		return nil, err
+	}
+	var proxyURL *url.URL
+	if o.Proxy != "" {
+		if proxyURL, err = parseProxy(o.Proxy); err != nil {
+			log.S(log.Error, "Bad proxy url", log.Str("proxy", o.Proxy), log.Attr("err", err),
+				log.Attr("thread", o.ID), log.Attr("run", o.UniqueID))
+			return nil, err
+		}
+		client.proxyStats = stats.NewHistogram(o.Offset.Seconds(), o.Resolution)
+	}
+	// http proxies get absolute-form requests from the transport (so addr is the proxy's below),
+	// we handle the CONNECT and socks tunnels ourselves.
+	tunnel := proxyURL != nil && !absoluteForm(proxyURL, o.https)
 	dialCtx := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		// redirect all connections to resolved ip, and use cn as sni host
-		if o.Resolve != "" {
+		if o.Resolve != "" && !tunnel {
 			addr = o.Resolve + addr[strings.LastIndex(addr, ":"):]
 		}
 		var conn net.Conn
 		now := time.Now()
-		conn, err = (&net.Dialer{
+		d := &net.Dialer{
 			Timeout: o.HTTPReqTimeOut,
-		}).DialContext(ctx, network, addr)
+		}
+		if tunnel {
+			if client.source != nil {
+				d.LocalAddr = client.source.LocalAddr(network)
+			}
+			conn, err = dialProxy(ctx, d, proxyURL, proxyURL.Host, addr, o.https)
+		} else {
+			conn, err = client.source.DialContext(ctx, d, network, addr)
+		}
+		if proxyURL != nil {
+			client.proxyStats.Record(time.Since(now).Seconds())
+		}
 		client.connectStats.Record(time.Since(now).Seconds())
 		if conn != nil {
+			conn = &trackedConn{Conn: conn, stats: client.connStats, start: time.Now()}
 			newRemoteAddress := conn.RemoteAddr().String()
 			// No change when it wasn't set before (first time) and when the value isn't actually changing either.
 			if req.RemoteAddr != "" && newRemoteAddress != req.RemoteAddr {
@@ -609,19 +777,26 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 	tr := &http.Transport{
 		MaxIdleConns:        o.NumConnections,
 		MaxIdleConnsPerHost: o.NumConnections,
-		DisableCompression:  !o.Compression,
+		DisableCompression:  !o.Compression && !o.Decompress,
 		DisableKeepAlives:   o.DisableKeepAlive,
 		Proxy:               http.ProxyFromEnvironment,
 		DialContext:         dialCtx,
 		TLSHandshakeTimeout: o.HTTPReqTimeOut,
 		ForceAttemptHTTP2:   o.H2,
 	}
+	if proxyURL != nil {
+		tr.Proxy = nil
+		if !tunnel {
+			tr.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
 	client.transport = tr // internal transport, unwrapped (to close idle conns)
 	if o.https {
 		tr.TLSClientConfig, err = o.TLSOptions.TLSConfig()
 		if err != nil {
 			return nil, err
 		}
+		client.tlsStats = NewTLSStats(o.Offset.Seconds(), o.Resolution)
 	} else if o.H2 {
 		// Need to do h2c instead of normal transport
 		// Note: this likely means connection multiplexing / not sure how to force unique connections
@@ -634,7 +809,7 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
 				return dialCtx(ctx, network, addr)
 			},
-			DisableCompression: !o.Compression,
+			DisableCompression: !o.Compression && !o.Decompress,
 		}
 		client.transport = tr2
 	}
@@ -689,7 +864,7 @@ func StreamFetch(httpOptions *HTTPOptions) int {
 	return code
 }
 
-// FastClient is a fast, lockfree single purpose http 1.0/1.1 client.
+// FastClient is a fast, lockfree single purpose http 1.0/1.1 (and lean h2) client.
 type FastClient struct {
 	buffer       []byte
 	req          []byte
@@ -705,11 +880,11 @@ type FastClient struct {
 	hostname     string
 	port         string
 	http10       bool // http 1.0, simplest: no Host, forced no keepAlive, no parsing
+	head         bool // HEAD request: the response has no body
 	keepAlive    bool
 	parseHeaders bool // don't bother in http/1.0
 	halfClose    bool // allow/do half close when keepAlive is false
 	reqTimeout   time.Duration
-	uuidMarkers  [][]byte
 	logErrors    bool
 	id           int
 	runID        int64
@@ -725,6 +900,50 @@ type FastClient struct {
 	reuseCount     int
 	connectStats   *stats.Histogram
 	dataWriter     io.Writer
+	proxy          *url.URL         // optional egress proxy, dest is then the proxy's address
+	proxyStats     *stats.Histogram // proxy connection and tunnel setup time
+	tlsStats       *TLSStats        // handshakes, when using https
+	info           *FetchInfo
+	source         *fnet.SourceAddress
+	// Current connection start and number of requests made on it, and stats of the closed ones.
+	connStart    time.Time
+	connRequests int64
+	connStats    *connectionStats
+	// Per request templating (nil when there is no {token} in the url, headers or payload).
+	headTemplate  *requestTemplate // request line and headers (without the final CRLF)
+	bodyTemplate  *requestTemplate // payload (when set, headTemplate is set too)
+	bodyLength    bool             // whether to add the Content-Length for each (templated) payload
+	templateState templateState
+	retry         bool   // next requests are retries: resend the last rendered one
+	rendered      bool   // reqBuffer has the last rendered request
+	reqBuffer     []byte // reused for rendering templated requests
+	bodyBuffer    []byte // reused for rendering templated payloads
+	// http/2 (h2 or h2c) mode
+	h2          bool
+	h2Scheme    string
+	h2Fields    []hpack.HeaderField // pre computed request headers (when not templated)
+	h2Body      []byte
+	h2group     *h2Group // connection, possibly shared with other clients
+	streamCount int64
+	// pipelining mode
+	pipeline      int       // number of requests per batch, when > 1
+	pending       int       // responses of the current batch still to be read
+	maxBatch      int64     // when > 0, caps the size of the next batch (calls left to do)
+	batchSize     int       // number of requests in the current batch
+	batchStart    time.Time // when the current batch of requests was sent
+	batchReq      []byte    // pre computed batch (when not templated)
+	leftover      int64     // bytes of the next response(s) already read, starting at leftoverStart
+	leftoverStart int64
+	// session (cookies and login token)
+	jar          http.CookieJar
+	jarURL       *url.URL
+	cookie       string // Cookie header value for the next requests
+	cookieBuffer []byte // reused for adding the Cookie header
+	tokenHeader  string
+	token        string
+	decoder      *decoder // set when decompressing responses
+	// to read the whole response of the non 2xx codes it accepts
+	validation *ResponseValidation
 }
 
 // GetIPAddress get ip address that DNS resolved to when using fast client and connection stats.
@@ -740,42 +959,25 @@ func (c *FastClient) HasBuffer() bool {
 func (c *FastClient) Close() {
 	log.Debugf("[%d] Closing %p %s socket count %d", c.id, c, c.url, c.socketCount)
 	if c.socket != nil {
+		c.socketClosed(false)
 		if err := c.socket.Close(); err != nil {
 			log.S(log.Warning, "Error closing fast client's socket",
 				log.Attr("err", err), log.Attr("thread", c.id), log.Attr("run", c.runID))
 		}
 		c.socket = nil
 	}
+	if c.h2group != nil {
+		c.h2group.release()
+		c.h2group = nil
+	}
 }
 
 // NewFastClient makes a basic, efficient http 1.0/1.1 client.
 // This function itself doesn't need to be super efficient as it is created at
 // the beginning and then reused many times.
 func NewFastClient(o *HTTPOptions) (Fetcher, error) { //nolint:funlen
-	method := o.Method()
-	payloadLen := len(o.Payload)
 	o.Init(o.URL)
-	proto := "1.1"
-	if o.HTTP10 {
-		proto = "1.0"
-	}
-
-	uuidStrings := []string{}
 	urlString := o.URL
-	for strings.Contains(urlString, uuidToken) {
-		uuidString := generateUUID()
-		uuidStrings = append(uuidStrings, uuidString)
-		urlString = strings.Replace(urlString, uuidToken, uuidString, 1)
-	}
-	payload := string(o.Payload)
-	for strings.Contains(payload, uuidToken) {
-		uuidString := generateUUID()
-		uuidStrings = append(uuidStrings, uuidString)
-		payload = strings.Replace(payload, uuidToken, uuidString, 1)
-	}
-	if len(uuidStrings) > 0 {
-		o.Payload = []byte(payload)
-	}
 	// Parse the url, extract components.
 	url, err := url.Parse(urlString)
 	if err != nil {
@@ -801,20 +1003,50 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) { //nolint:funlen
 		https: o.https, connReuseRange: o.ConnReuseRange, connReuse: connReuse,
 		resolve: o.Resolve, noResolveEachConn: o.NoResolveEachConn, ipAddrUsage: stats.NewOccurrence(),
 		// Keep track of timing for connection (re)establishment.
-		connectStats: stats.NewHistogram(o.Offset.Seconds(), o.Resolution),
-		dataWriter:   o.DataWriter,
+		connectStats:  stats.NewHistogram(o.Offset.Seconds(), o.Resolution),
+		dataWriter:    o.DataWriter,
+		templateState: templateState{thread: o.ID, runID: o.UniqueID},
+		info:          o.FetchInfo,
+		connStats:     newConnectionStats(o.Resolution),
+		validation:    o.Validation,
 	}
 	if o.https {
 		bc.tlsConfig, err = o.TLSOptions.TLSConfig()
 		if err != nil {
 			return nil, err
 		}
+		bc.tlsStats = NewTLSStats(o.Offset.Seconds(), o.Resolution)
+	}
+	if o.H2 {
+		bc.h2 = true
+		if o.HTTP10 {
+			log.Warnf("[%d] Both http/1.0 and h2 requested, using http/1.0", bc.id)
+			bc.h2 = false
+		}
+		if bc.tlsConfig != nil && len(o.ALPN) == 0 {
+			bc.tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		}
 	}
 	bc.buffer = make([]byte, BufferSizeKb*1024)
 	if bc.port == "" {
 		bc.port = url.Scheme // ie http which turns into 80 later
 		log.LogVf("[%d] No port specified, using %s", bc.id, bc.port)
 	}
+	if bc.source, err = fnet.GetSourceAddress(o.SourceAddress); err != nil {
+		return nil, err
+	}
+	if o.Proxy != "" {
+		if bc.proxy, err = parseProxy(o.Proxy); err != nil {
+			log.S(log.Error, "Bad proxy url", log.Str("proxy", o.Proxy), log.Attr("err", err),
+				log.Attr("thread", o.ID), log.Attr("run", o.UniqueID))
+			return nil, err
+		}
+		bc.proxyStats = stats.NewHistogram(o.Offset.Seconds(), o.Resolution)
+		if bc.h2 && absoluteForm(bc.proxy, o.https) {
+			log.Warnf("[%d] h2c isn't possible through an http proxy, using http/1.1", bc.id)
+			bc.h2 = false
+		}
+	}
 	var addr net.Addr
 	if o.UnixDomainSocket != "" {
 		log.S(log.Info, "Using unix domain socket", log.Attr("path", o.UnixDomainSocket),
@@ -824,62 +1056,263 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) { //nolint:funlen
 	} else {
 		var tAddr *net.TCPAddr // strangely we get a non nil wrap of nil if assigning to addr directly
 		var err error
-		tAddr, err = resolve(context.Background(), bc.hostname, bc.port, o.Resolve, bc.ipAddrUsage)
+		hostname, port := bc.dialHostPort()
+		tAddr, err = resolve(context.Background(), hostname, port, o.Resolve, bc.ipAddrUsage)
 		if tAddr == nil {
 			// Error already logged
 			return nil, err
 		}
 		addr = tAddr
 	}
+	bc.info.markNameLookup()
 	bc.dest = addr
-	// Create the bytes for the request:
-	host := bc.host
+	if bc.tlsConfig != nil && bc.tlsConfig.ServerName == "" {
+		bc.tlsConfig.ServerName = bc.hostname // Shouldn't have a port #571
+	}
+	bc.reqTimeout = o.HTTPReqTimeOut
+	if o.Decompress {
+		bc.decoder = &decoder{}
+	}
+	if bc.jar, bc.tokenHeader, bc.token, err = o.session(); err != nil {
+		return nil, err
+	}
+	if bc.jar != nil {
+		bc.jarURL = url
+		bc.cookie = cookieHeader(bc.jar.Cookies(url))
+	}
+	if err = bc.makeRequest(o, url); err != nil {
+		return nil, err
+	}
+	if o.Pipeline > 1 {
+		switch {
+		case bc.h2 || bc.http10 || !bc.keepAlive:
+			log.Warnf("[%d] Pipelining is only possible with http/1.1 and keepalive, ignoring", bc.id)
+		default:
+			bc.pipeline = o.Pipeline
+			if bc.headTemplate == nil {
+				bc.batchReq = bytes.Repeat(bc.req, bc.pipeline)
+			}
+		}
+	}
+	if bc.h2 {
+		bc.h2Scheme = url.Scheme
+		bc.h2Fields, bc.h2Body = h2Request(bc.req, bc.h2Scheme)
+		if o.h2Groups != nil {
+			bc.h2group = o.h2Groups.get(bc.id, bc.host)
+		} else {
+			bc.h2group = &h2Group{users: 1}
+		}
+	}
+	log.Debugf("[%d] Created client:\n%+v\n%s", bc.id, bc.dest, bc.req)
+	return &bc, nil
+}
+
+// dialHostPort returns the host name and port to resolve and connect to: the proxy's when set.
+func (c *FastClient) dialHostPort() (string, string) {
+	if c.proxy != nil {
+		return c.proxy.Hostname(), c.proxy.Port()
+	}
+	return c.hostname, c.port
+}
+
+// makeRequest creates the bytes for the request (and the templates if any)
+// for the given options and parsed url. Uses the host and http10 fields of c.
+func (c *FastClient) makeRequest(o *HTTPOptions, url *url.URL) error {
+	method := o.Method()
+	payloadLen := len(o.Payload)
+	proto := "1.1"
+	if c.http10 {
+		proto = "1.0"
+	}
+	var err error
+	c.head = (method == http.MethodHead)
+	host := c.host
 	customHostHeader := (o.hostOverride != "")
 	if customHostHeader {
 		host = o.hostOverride
 	}
-	if bc.tlsConfig != nil {
-		bc.tlsConfig.ServerName = bc.hostname // Shouldn't have a port #571
+	requestURI := url.RequestURI()
+	urlTemplated := hasTemplate(o.URL)
+	if urlTemplated {
+		// RequestURI() would escape the { } of the tokens
+		requestURI = rawRequestURI(o.URL)
+	}
+	var proxyAuth string
+	if o.Proxy != "" {
+		p, _ := parseProxy(o.Proxy) // already validated
+		if absoluteForm(p, o.https) {
+			requestURI = url.Scheme + "://" + url.Host + requestURI
+			proxyAuth = proxyAuthorization(p)
+		}
 	}
 	var buf bytes.Buffer
-	buf.WriteString(method + " " + url.RequestURI() + " HTTP/" + proto + "\r\n")
-	if !bc.http10 || customHostHeader {
+	buf.WriteString(method + " " + requestURI + " HTTP/" + proto + "\r\n")
+	if !c.http10 || customHostHeader {
 		buf.WriteString("Host: " + host + "\r\n")
 	}
-	if !bc.http10 {
+	if proxyAuth != "" {
+		buf.WriteString("Proxy-Authorization: " + proxyAuth + "\r\n")
+	}
+	if !c.http10 {
 		// Rest of normal http 1.1 processing:
-		bc.parseHeaders = true
+		c.parseHeaders = true
 		if !o.DisableKeepAlive {
-			bc.keepAlive = true
+			c.keepAlive = true
 		} else {
 			buf.WriteString("Connection: close\r\n")
 		}
 	}
-	bc.reqTimeout = o.HTTPReqTimeOut
+	headers := o.GenerateHeaders()
+	if (o.Compression || o.Decompress) && len(headers.Get("Accept-Encoding")) == 0 {
+		headers.Set("Accept-Encoding", AcceptEncoding)
+	}
+	if c.tokenHeader != "" {
+		headers.Set(c.tokenHeader, c.token)
+	}
+	c.bodyTemplate, err = parseTemplate(string(o.Payload))
+	if err != nil {
+		log.S(log.Error, "Bad payload template", log.Attr("err", err), log.Attr("thread", o.ID), log.Attr("run", o.UniqueID))
+		return err
+	}
+	if c.bodyTemplate != nil && len(o.extraHeaders.Get(contentLength)) == 0 {
+		// will be computed for each request
+		headers.Del(contentLength)
+		c.bodyLength = true
+	}
 	w := bufio.NewWriter(&buf)
 	// This writes multiple valued headers properly (unlike calling Get() to do it ourselves)
-	_ = o.GenerateHeaders().Write(w)
+	_ = headers.Write(w)
 	w.Flush()
+	if c.bodyTemplate != nil || urlTemplated || hasTemplate(buf.String()) {
+		c.headTemplate, err = parseTemplate(buf.String())
+		if err != nil {
+			log.S(log.Error, "Bad url or header template", log.Attr("err", err), log.Attr("thread", o.ID), log.Attr("run", o.UniqueID))
+			return err
+		}
+		if c.headTemplate == nil {
+			// only the payload is templated
+			c.headTemplate = &requestTemplate{parts: []templatePart{{kind: tmplLiteral, literal: buf.Bytes()}}}
+		}
+		if c.bodyTemplate == nil && payloadLen > 0 {
+			c.bodyTemplate = &requestTemplate{parts: []templatePart{{kind: tmplLiteral, literal: o.Payload}}}
+		}
+	}
 	buf.WriteString("\r\n")
 	// Add the payload to http body
 	if payloadLen > 0 {
 		buf.Write(o.Payload)
 	}
-	bc.req = buf.Bytes()
-	bc.uuidMarkers = [][]byte{}
-	if len(uuidStrings) > 0 {
-		for _, uuidString := range uuidStrings {
-			bc.uuidMarkers = append(bc.uuidMarkers, []byte(uuidString))
+	c.req = buf.Bytes()
+	return nil
+}
+
+// renderRequest generates the bytes of the request when templates are used.
+// Reuses the client's buffers so it doesn't allocate in steady state.
+func (c *FastClient) renderRequest() []byte {
+	ts := &c.templateState
+	c.reqBuffer = c.headTemplate.Append(c.reqBuffer[:0], ts)
+	if c.cookie != "" {
+		c.reqBuffer = append(c.reqBuffer, "Cookie: "...)
+		c.reqBuffer = append(c.reqBuffer, c.cookie...)
+		c.reqBuffer = append(c.reqBuffer, '\r', '\n')
+	}
+	hasBody := c.bodyTemplate != nil
+	if hasBody {
+		c.bodyBuffer = c.bodyTemplate.Append(c.bodyBuffer[:0], ts)
+		if c.bodyLength {
+			c.reqBuffer = append(c.reqBuffer, contentLength+": "...)
+			c.reqBuffer = strconv.AppendInt(c.reqBuffer, int64(len(c.bodyBuffer)), 10)
+			c.reqBuffer = append(c.reqBuffer, '\r', '\n')
 		}
 	}
-	log.Debugf("[%d] Created client:\n%+v\n%s", bc.id, bc.dest, bc.req)
-	return &bc, nil
+	c.reqBuffer = append(c.reqBuffer, '\r', '\n')
+	if hasBody {
+		c.reqBuffer = append(c.reqBuffer, c.bodyBuffer...)
+	}
+	ts.seq++
+	return c.reqBuffer
+}
+
+// batchRequest returns the pipelined requests to send back to back.
+func (c *FastClient) batchRequest() []byte {
+	c.batchSize = c.pipeline
+	if c.maxBatch > 0 && c.maxBatch < int64(c.batchSize) {
+		c.batchSize = int(c.maxBatch)
+	}
+	if c.headTemplate == nil && c.cookie == "" {
+		return c.batchReq[:c.batchSize*len(c.req)]
+	}
+	c.batchReq = c.batchReq[:0]
+	for i := 0; i < c.batchSize; i++ {
+		c.batchReq = append(c.batchReq, c.nextRequest()...)
+	}
+	return c.batchReq
+}
+
+// readPipelined reads the next response of the current batch, starting with
+// the bytes already read past the previous response.
+func (c *FastClient) readPipelined() {
+	c.pending--
+	conn := c.socket
+	if conn == nil {
+		// connection closed (or error) before all the responses were read.
+		return
+	}
+	c.socket = nil
+	copy(c.buffer, c.buffer[c.leftoverStart:c.leftoverStart+c.leftover])
+	c.size = c.leftover
+	c.leftover = 0
+	_ = conn.SetDeadline(time.Now().Add(c.reqTimeout))
+	c.readResponse(conn, false)
+}
+
+// pipelineLeftover keeps the bytes read past the end of the current response,
+// which belong to the next one(s), and makes the response end there.
+func (c *FastClient) pipelineLeftover(keepAlive, chunkedMode bool, max, end int64) {
+	c.leftover = 0
+	if !keepAlive {
+		if c.pending > 0 {
+			log.S(log.Warning, "Connection closed with pipelined responses pending", log.Attr("pending", c.pending),
+				log.Attr("thread", c.id), log.Attr("run", c.runID))
+		}
+		return
+	}
+	if !chunkedMode {
+		end = max
+	}
+	if end < 0 || c.size <= end {
+		return
+	}
+	c.leftover = c.size - end
+	c.leftoverStart = end
+	c.size = end
+}
+
+// RequestStart is when the request of the last response was sent in pipelining mode
+// (zero time otherwise).
+func (c *FastClient) RequestStart() time.Time {
+	if c.pipeline <= 1 {
+		return time.Time{}
+	}
+	return c.batchStart
 }
 
 // return the result from the state.
 func (c *FastClient) returnRes() (int, int64, uint) {
+	if c.decoder != nil {
+		c.decode()
+	}
+	if c.jar != nil && c.headerLen > 0 {
+		c.updateCookies()
+	}
+	c.info.fastResponse(c.code, c.buffer[:c.size], c.headerLen)
 	if c.dataWriter != nil && c.dataWriter != io.Discard {
-		_, _ = c.dataWriter.Write(c.buffer[:c.size])
+		if c.decoder != nil && c.decoder.decoded != nil {
+			_, _ = c.dataWriter.Write(c.buffer[:c.headerLen])
+			_, _ = c.dataWriter.Write(c.decoder.decoded)
+		} else {
+			_, _ = c.dataWriter.Write(c.buffer[:c.size])
+		}
 	}
 	return c.code, c.size, c.headerLen
 }
@@ -892,10 +1325,11 @@ func (c *FastClient) connect(ctx context.Context) net.Conn {
 
 	// Resolve the DNS name when making new connections.
 	if c.socketCount > 1 && !c.noResolveEachConn {
-		c.dest, err = resolve(ctx, c.hostname, c.port, c.resolve, c.ipAddrUsage)
-		log.Debugf("[%d] Hostname %v resolve to ip %v", c.id, c.hostname, c.dest)
+		hostname, port := c.dialHostPort()
+		c.dest, err = resolve(ctx, hostname, port, c.resolve, c.ipAddrUsage)
+		log.Debugf("[%d] Hostname %v resolve to ip %v", c.id, hostname, c.dest)
 		if err != nil {
-			log.S(log.Error, "Unable to resolve hostname", log.Str("hostname", c.hostname), log.Attr("err", err),
+			log.S(log.Error, "Unable to resolve hostname", log.Str("hostname", hostname), log.Attr("err", err),
 				log.Attr("thread", c.id), log.Attr("run", c.runID))
 			return nil
 		}
@@ -903,8 +1337,26 @@ func (c *FastClient) connect(ctx context.Context) net.Conn {
 
 	d := &net.Dialer{Timeout: c.reqTimeout}
 	now := time.Now()
-	if c.https {
-		socket, err = tls.DialWithDialer(d, c.dest.Network(), c.dest.String(), c.tlsConfig)
+	if c.proxy != nil {
+		if c.source != nil {
+			d.LocalAddr = c.source.LocalAddr(c.dest.Network())
+		}
+		socket, err = dialProxy(ctx, d, c.proxy, c.dest.String(), hostPort(c.hostname, c.port), c.https)
+		c.proxyStats.Record(time.Since(now).Seconds())
+		if err == nil && c.https {
+			socket, err = c.tlsHandshake(socket)
+		}
+		c.connectStats.Record(time.Since(now).Seconds())
+		if err != nil {
+			log.S(log.Error, "Unable to connect through proxy", log.Attr("proxy", c.dest), log.Str("host", c.host), log.Attr("err", err),
+				log.Attr("thread", c.id), log.Attr("run", c.runID))
+			return nil
+		}
+	} else if c.https {
+		socket, err = c.source.DialContext(ctx, d, c.dest.Network(), c.dest.String())
+		if err == nil {
+			socket, err = c.tlsHandshake(socket)
+		}
 		c.connectStats.Record(time.Since(now).Seconds())
 		if err != nil {
 			log.S(log.Error, "Unable to TLS connect", log.Attr("dest", c.dest), log.Attr("err", err),
@@ -912,7 +1364,7 @@ func (c *FastClient) connect(ctx context.Context) net.Conn {
 			return nil
 		}
 	} else {
-		socket, err = d.Dial(c.dest.Network(), c.dest.String())
+		socket, err = c.source.DialContext(ctx, d, c.dest.Network(), c.dest.String())
 		c.connectStats.Record(time.Since(now).Seconds())
 		if err != nil {
 			log.S(log.Error, "Unable to connect", log.Attr("dest", c.dest), log.Attr("err", err),
@@ -920,16 +1372,39 @@ func (c *FastClient) connect(ctx context.Context) net.Conn {
 			return nil
 		}
 	}
+	c.info.markConnected(socket)
+	c.connStart = time.Now()
+	c.connRequests = 0
 	fnet.SetSocketBuffers(socket, len(c.buffer), len(c.req))
 	return socket
 }
 
+// tlsHandshake does (and records the stats of) the client side TLS handshake
+// on an already connected socket (direct or proxy tunnel).
+func (c *FastClient) tlsHandshake(socket net.Conn) (net.Conn, error) {
+	tlsConn := tls.Client(socket, c.tlsConfig)
+	_ = tlsConn.SetDeadline(time.Now().Add(c.reqTimeout))
+	c.info.markConnect()
+	start := time.Now()
+	if err := tlsConn.Handshake(); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	cs := tlsConn.ConnectionState()
+	c.tlsStats.record(time.Since(start), &cs)
+	c.info.markTLSDone(&cs)
+	return tlsConn, nil
+}
+
 // Extra error codes outside of the HTTP Status code ranges. ie negative.
 const (
 	// SocketError is return when a transport error occurred: unexpected EOF, connection error, etc...
 	SocketError = -1
 	// RetryOnce is used internally as an error code to allow 1 retry for bad socket reuse.
 	RetryOnce = -2
+	// DecompressionError is returned when the fast client can't decode a compressed response.
+	DecompressionError = -3
 )
 
 // Fetch fetches the url content. Returns http code, data, offset of body.
@@ -947,6 +1422,13 @@ func (c *FastClient) StreamFetch(ctx context.Context) (int, int64, uint) {
 	c.code = SocketError
 	c.size = 0
 	c.headerLen = 0
+	if c.h2 && c.fetchH2(ctx) {
+		return c.returnRes()
+	} // else switched to http/1.1
+	if c.pending > 0 {
+		c.readPipelined()
+		return c.returnRes()
+	}
 	// Connect or reuse existing socket:
 	conn := c.socket
 	canReuse := conn != nil
@@ -970,16 +1452,19 @@ func (c *FastClient) StreamFetch(ctx context.Context) (int, int64, uint) {
 	conErr := conn.SetDeadline(time.Now().Add(c.reqTimeout))
 	// Send the request:
 	req := c.req
-	if len(c.uuidMarkers) > 0 {
-		for _, uuidMarker := range c.uuidMarkers {
-			req = bytes.Replace(req, uuidMarker, []byte(generateUUID()), 1)
-		}
+	if c.pipeline > 1 {
+		req = c.batchRequest()
+		c.leftover = 0
+		c.batchStart = time.Now()
+	} else {
+		req = c.nextRequest()
 	}
 	n, err := conn.Write(req)
 	if err != nil || conErr != nil {
 		if canReuse {
 			// it's ok for the (idle) socket to die once, auto reconnect:
 			log.S(log.Info, "Closing dead socket", log.Attr("err", err), log.Attr("thread", c.id), log.Attr("run", c.runID))
+			c.socketClosed(true)
 			conn.Close()
 			c.errorCount++
 			return c.StreamFetch(ctx) // recurse once
@@ -987,8 +1472,8 @@ func (c *FastClient) StreamFetch(ctx context.Context) (int, int64, uint) {
 		log.S(log.Error, "Unable to write", log.Attr("err", err), log.Attr("thread", c.id), log.Attr("run", c.runID))
 		return c.returnRes()
 	}
-	if n != len(c.req) {
-		log.S(log.Error, "Short write", log.Attr("err", err), log.Attr("actual", n), log.Attr("expected", len(c.req)),
+	if n != len(req) {
+		log.S(log.Error, "Short write", log.Attr("err", err), log.Attr("actual", n), log.Attr("expected", len(req)),
 			log.Attr("thread", c.id), log.Attr("run", c.runID))
 		return c.returnRes()
 	}
@@ -1005,9 +1490,13 @@ func (c *FastClient) StreamFetch(ctx context.Context) (int, int64, uint) {
 				log.Attr("err", err), log.Attr("thread", c.id), log.Attr("run", c.runID))
 		}
 	}
+	if c.pipeline > 1 {
+		c.pending = c.batchSize - 1
+	}
 	// Read the response:
 	c.readResponse(conn, canReuse)
 	if c.code == RetryOnce {
+		c.pending = 0
 		// Special "eof on reused socket" code
 		return c.StreamFetch(ctx) // recurse once
 	}
@@ -1025,6 +1514,7 @@ func codeIsOK(code int) bool {
 //nolint:nestif,funlen,gocognit,gocyclo,maintidx // TODO: refactor - unwiedly/ugly atm.
 func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 	max := int64(len(c.buffer))
+	end := int64(-1) // end of the response, when known, for pipelining
 	parsedHeaders := false
 	// TODO: safer to start with -1 / SocketError and fix ok for http 1.0
 	c.code = http.StatusOK // In http 1.0 mode we don't bother parsing anything
@@ -1032,7 +1522,9 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 	keepAlive := c.keepAlive
 	chunkedMode := false
 	checkConnectionClosedHeader := CheckConnectionClosedHeader
-	skipRead := false
+	skipRead := c.size > 0 // pipelined response already (partially) read
+	serverClose := false   // the server closed (or asked to close) the connection
+	c.connRequests++
 	for {
 		// Ugly way to cover the case where we get more than 1 chunk at the end
 		// TODO: need automated tests
@@ -1040,11 +1532,13 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 			nI, err := conn.Read(c.buffer[c.size:])
 			n := int64(nI)
 			if err != nil {
-				if reusedSocket && c.size == 0 {
+				if reusedSocket && c.size == 0 && n == 0 {
 					// Ok for reused socket to be dead once (close by server)
 					log.S(log.Info, "Closing dead socket (err at first read)",
 						log.Attr("err", err), log.Attr("thread", c.id), log.Attr("run", c.runID))
 					c.errorCount++
+					c.connRequests--
+					c.socketClosed(true)
 					err = conn.Close() // close the previous one
 					if err != nil {
 						log.S(log.Warning, "Error closing dead socket", log.Attr("err", err), log.Attr("thread", c.id), log.Attr("run", c.runID))
@@ -1052,15 +1546,22 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 					c.code = RetryOnce // special "retry once" code
 					return
 				}
-				if errors.Is(err, io.EOF) && c.size != 0 {
+				if errors.Is(err, io.EOF) && c.size+n != 0 {
 					// handled below as possibly normal end of stream after we read something
+					// (tls can return the last data along with the EOF)
+					c.size += n
+					serverClose = true
 					break
 				}
 				log.S(log.Error, "Read error", log.Attr("err", err), log.Attr("size", c.size), log.Attr("dest", c.dest), log.Str("url", c.url),
 					log.Attr("thread", c.id), log.Attr("run", c.runID))
 				c.code = SocketError
+				serverClose = !isTimeout(err)
 				break
 			}
+			if c.size == 0 && c.info != nil {
+				c.info.markFirstByte()
+			}
 			c.size += n
 			if log.LogDebug() {
 				log.Debugf("[%d] Read ok %d total %d so far (-%d headers = %d data) %s",
@@ -1079,7 +1580,9 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 					log.S(log.Warning, "Non ok http code", log.Attr("code", c.code), log.Str("status", string(c.buffer[:retcodeOffset+3])),
 						log.Attr("thread", c.id), log.Attr("run", c.runID))
 				}
-				break
+				if !c.readsWholeResponse() {
+					break
+				}
 			}
 			if log.LogDebug() {
 				log.Debugf("[%d] Code %d, looking for end of headers at %d / %d, last CRLF %d",
@@ -1105,8 +1608,12 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 				if log.LogDebug() {
 					log.Debugf("[%d] headers are %d: %q", c.id, c.headerLen, c.buffer[:idx])
 				}
+				if c.head {
+					// No body for HEAD responses, whichever the Content-Length or Transfer-Encoding
+					max = int64(c.headerLen)
+				}
 				// Find the content length or chunked mode
-				if keepAlive {
+				if keepAlive && !c.head {
 					var contentLength int64
 					found, offset := FoldFind(c.buffer[:c.headerLen], contentLengthHeader)
 					if found {
@@ -1150,6 +1657,9 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 						}
 					} // end of content-length section
 					if max > int64(len(c.buffer)) {
+						if c.pipeline > 1 {
+							keepAlive = false // can't find the next response
+						}
 						log.S(log.Warning, "Buffer is too small for headers + data - change -httpbufferkb flag",
 							log.Attr("header_len", c.headerLen),
 							log.Attr("content_length", contentLength),
@@ -1163,6 +1673,7 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 						if found, _ := FoldFind(c.buffer[:c.headerLen], connectionCloseHeader); found {
 							log.S(log.Info, "Server wants to close connection, no keep-alive!", log.Attr("thread", c.id), log.Attr("run", c.runID))
 							keepAlive = false
+							serverClose = true
 							max = int64(len(c.buffer)) // reset to read as much as available
 						}
 					}
@@ -1170,7 +1681,7 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 			}
 		} // end of big if parse header
 		if c.size >= max {
-			if !keepAlive {
+			if !keepAlive && !c.head {
 				log.S(log.Error, "More data is available but stopping after max, increase -httpbufferkb",
 					log.Attr("max", max), log.Attr("thread", c.id), log.Attr("run", c.runID))
 			}
@@ -1193,7 +1704,8 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 					continue
 				} else if nextChunkLen == 0 {
 					log.Debugf("[%d] Found last chunk %d %d", c.id, max+dataStart, c.size)
-					if c.size != max+dataStart+2 || string(c.buffer[c.size-2:c.size]) != "\r\n" {
+					end = max + dataStart + 2
+					if c.size < end || (c.pipeline <= 1 && c.size != end) || string(c.buffer[end-2:end]) != "\r\n" {
 						log.S(log.Error, "Unexpected mismatch at the end",
 							log.Attr("size", c.size), log.Attr("expected", max+dataStart+2),
 							log.Attr("end-of_buffer", c.buffer[max:c.size]),
@@ -1204,6 +1716,9 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 					log.Debugf("[%d] One more chunk %d -> new max %d", c.id, nextChunkLen, max)
 					if max > int64(len(c.buffer)) {
 						log.S(log.Error, "Buffer too small for data", log.Attr("size", max), log.Attr("thread", c.id), log.Attr("run", c.runID))
+						if c.pipeline > 1 {
+							keepAlive = false
+						}
 					} else {
 						if max <= c.size {
 							log.Debugf("[%d] Enough data to reach next chunk, skipping a read", c.id)
@@ -1216,10 +1731,18 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 			break // we're done!
 		}
 	} // end of big for loop
+	if c.pipeline > 1 {
+		c.pipelineLeftover(keepAlive, chunkedMode, max, end)
+		if keepAlive && parsedHeaders && (c.pending > 0 || !c.reachedReuseThreshold()) {
+			c.socket = conn // whole response was read, whichever the code
+			return
+		}
+	}
 	// Figure out whether to keep or close the socket:
-	if keepAlive && codeIsOK(c.code) && !c.reachedReuseThreshold() {
+	if keepAlive && (codeIsOK(c.code) || (parsedHeaders && c.readsWholeResponse())) && !c.reachedReuseThreshold() {
 		c.socket = conn // keep the open socket
 	} else {
+		c.socketClosed(c.keepAlive && serverClose)
 		if err := conn.Close(); err != nil {
 			log.S(log.Error, "Close error", log.Attr("err", err), log.Attr("size", c.size),
 				log.Attr("thread", c.id), log.Attr("run", c.runID))
@@ -1230,6 +1753,13 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 	}
 }
 
+// readsWholeResponse returns whether a non ok c.code response must still be read entirely:
+// when pipelining, to get to the next one, with cookies, for the ones it sets (e.g. along a 302)
+// and for codes accepted by the validation, to check it.
+func (c *FastClient) readsWholeResponse() bool {
+	return c.pipeline > 1 || c.jar != nil || (c.validation != nil && c.validation.statusOK(c.code))
+}
+
 // Check if current thread reached the connection reuse threshold.
 func (c *FastClient) reachedReuseThreshold() bool {
 	if c.connReuse != 0 && c.reuseCount >= c.connReuse {
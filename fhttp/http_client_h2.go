@@ -0,0 +1,620 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Lean HTTP/2 code path of the FastClient: h2 (negotiated through ALPN) and
+// h2c (prior knowledge). Each FastClient (thread) has at most 1 stream in flight;
+// several clients can share the same connection (HTTPOptions.H2Streams).
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// Our receive window, for the connection and each stream.
+	h2Window = 1 << 20
+	// Default initial (send) window and max frame size until the peer's settings say otherwise.
+	h2DefaultWindow   = 65535
+	h2DefaultMaxFrame = 16384
+	h2MaxStreamID     = 1<<31 - 1
+)
+
+var (
+	// errH2Unavailable is returned when a stream couldn't even be started on the connection
+	// (going away, dead, or refused): the request can be retried on a new connection.
+	errH2Unavailable = errors.New("http/2 connection not available")
+	errH2Timeout     = errors.New("http/2 request timeout")
+)
+
+// h2Group is the http/2 connection shared by a group of FastClients.
+type h2Group struct {
+	mu    sync.Mutex
+	conn  *h2Conn
+	users int
+}
+
+// h2Groups assigns the FastClients of a run to shared connections, streams clients per connection.
+type h2Groups struct {
+	streams int
+	mu      sync.Mutex
+	groups  map[string]*h2Group
+}
+
+func newH2Groups(streams int) *h2Groups {
+	return &h2Groups{streams: streams, groups: make(map[string]*h2Group)}
+}
+
+// get returns the group for client id to host, registering one more user of it.
+func (g *h2Groups) get(id int, host string) *h2Group {
+	key := strconv.Itoa(id/g.streams) + " " + host
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	grp := g.groups[key]
+	if grp == nil {
+		grp = &h2Group{}
+		g.groups[key] = grp
+	}
+	grp.users++
+	return grp
+}
+
+// release is called by each user (client) when done, the last one closes the connection.
+func (g *h2Group) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.users--
+	if g.users <= 0 && g.conn != nil {
+		g.conn.close()
+		g.conn = nil
+	}
+}
+
+// h2Stream is the state of a request/response; buf is the client's buffer into which the
+// status line and headers (in http/1.x form, so the rest of fortio works unchanged) then as
+// much of the body as fits are copied.
+type h2Stream struct {
+	id          uint32
+	buf         []byte
+	size        int
+	dropped     int // bytes which didn't fit in buf
+	headerLen   int
+	code        int
+	sendWindow  int32
+	recvUnacked uint32
+	ended       bool // response complete, reset or connection error (err is then set)
+	expired     bool // timeout
+	err         error
+	timed       bool      // record when the headers are received, in headersAt
+	headersAt   time.Time // for the curl mode FetchInfo
+}
+
+// add copies what fits of data into the stream's buffer, counting the rest as dropped.
+func (st *h2Stream) add(data []byte) {
+	n := copy(st.buf[st.size:], data)
+	st.size += n
+	st.dropped += len(data) - n
+}
+
+// h2Conn is a client http/2 connection. Frames are read by a go routine which
+// updates the streams and signals cond.
+type h2Conn struct {
+	conn    net.Conn
+	framer  *http2.Framer
+	timeout time.Duration
+	// write side, wmu is never acquired while holding mu.
+	wmu    sync.Mutex
+	henc   *hpack.Encoder
+	hbuf   bytes.Buffer
+	nextID uint32
+	// state shared with the reader go routine.
+	mu          sync.Mutex
+	cond        *sync.Cond
+	streams     map[uint32]*h2Stream
+	closed      bool  // no new streams (going away, error or out of stream ids)
+	err         error // connection error
+	sendWindow  int32
+	peerWindow  int32 // initial stream window of the peer
+	maxFrame    uint32
+	maxStreams  uint32
+	recvUnacked uint32
+	scratch     []byte // to build headers
+}
+
+// newH2Conn sends the connection preface and settings and starts the reader.
+func newH2Conn(conn net.Conn, timeout time.Duration) (*h2Conn, error) {
+	h := &h2Conn{
+		conn: conn, timeout: timeout, nextID: 1, streams: make(map[uint32]*h2Stream),
+		sendWindow: h2DefaultWindow, peerWindow: h2DefaultWindow, maxFrame: h2DefaultMaxFrame, maxStreams: math.MaxUint32,
+	}
+	h.cond = sync.NewCond(&h.mu)
+	h.framer = http2.NewFramer(conn, bufio.NewReader(conn))
+	h.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	h.henc = hpack.NewEncoder(&h.hbuf)
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	_, err := conn.Write([]byte(http2.ClientPreface))
+	if err == nil {
+		err = h.framer.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0},
+			http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2Window})
+	}
+	if err == nil {
+		err = h.framer.WriteWindowUpdate(0, h2Window-h2DefaultWindow)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	go h.readLoop()
+	return h, nil
+}
+
+// write serializes frame writes.
+func (h *h2Conn) write(fn func() error) error {
+	h.wmu.Lock()
+	_ = h.conn.SetWriteDeadline(time.Now().Add(h.timeout))
+	err := fn()
+	h.wmu.Unlock()
+	if err != nil {
+		h.fail(err)
+	}
+	return err
+}
+
+// usable is true when new streams can be started.
+func (h *h2Conn) usable() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.closed
+}
+
+// retire stops new streams and closes the connection once the current ones are done.
+func (h *h2Conn) retire() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	if len(h.streams) == 0 {
+		h.conn.Close()
+	}
+}
+
+func (h *h2Conn) close() {
+	h.conn.Close() // the reader will then fail() the remaining streams
+}
+
+// finish ends the stream, must be called with mu held.
+func (h *h2Conn) finish(st *h2Stream, err error) {
+	if st.ended {
+		return
+	}
+	st.ended = true
+	st.err = err
+	delete(h.streams, st.id)
+	if h.closed && len(h.streams) == 0 {
+		h.conn.Close()
+	}
+	h.cond.Broadcast()
+}
+
+// fail is called on connection errors: all the streams end with err.
+func (h *h2Conn) fail(err error) {
+	h.mu.Lock()
+	if h.err == nil {
+		h.err = err
+	}
+	h.closed = true
+	for _, st := range h.streams {
+		h.finish(st, err)
+	}
+	h.cond.Broadcast()
+	h.mu.Unlock()
+	h.conn.Close()
+}
+
+func (h *h2Conn) readLoop() {
+	for {
+		f, err := h.framer.ReadFrame()
+		if err != nil {
+			h.fail(err)
+			return
+		}
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			h.onHeaders(f)
+		case *http2.DataFrame:
+			h.onData(f)
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				h.onSettings(f)
+			}
+		case *http2.WindowUpdateFrame:
+			h.mu.Lock()
+			if f.StreamID == 0 {
+				h.sendWindow += int32(f.Increment)
+			} else if st := h.streams[f.StreamID]; st != nil {
+				st.sendWindow += int32(f.Increment)
+			}
+			h.cond.Broadcast()
+			h.mu.Unlock()
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				_ = h.write(func() error { return h.framer.WritePing(true, f.Data) })
+			}
+		case *http2.RSTStreamFrame:
+			h.mu.Lock()
+			if st := h.streams[f.StreamID]; st != nil {
+				err := fmt.Errorf("stream reset by server: %v", f.ErrCode)
+				if f.ErrCode == http2.ErrCodeRefusedStream {
+					err = errH2Unavailable
+				}
+				h.finish(st, err)
+			}
+			h.mu.Unlock()
+		case *http2.GoAwayFrame:
+			log.LogVf("Received http/2 GOAWAY %v last stream %d", f.ErrCode, f.LastStreamID)
+			h.mu.Lock()
+			h.closed = true
+			for id, st := range h.streams {
+				if id > f.LastStreamID {
+					h.finish(st, errH2Unavailable)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *h2Conn) onSettings(f *http2.SettingsFrame) {
+	tableSize := int64(-1)
+	h.mu.Lock()
+	_ = f.ForeachSetting(func(s http2.Setting) error {
+		switch s.ID { //nolint:exhaustive // we only care about these
+		case http2.SettingInitialWindowSize:
+			delta := int32(s.Val) - h.peerWindow
+			for _, st := range h.streams {
+				st.sendWindow += delta
+			}
+			h.peerWindow = int32(s.Val)
+		case http2.SettingMaxFrameSize:
+			h.maxFrame = s.Val
+		case http2.SettingMaxConcurrentStreams:
+			h.maxStreams = s.Val
+		case http2.SettingHeaderTableSize:
+			tableSize = int64(s.Val)
+		}
+		return nil
+	})
+	h.cond.Broadcast()
+	h.mu.Unlock()
+	_ = h.write(func() error {
+		if tableSize >= 0 {
+			h.henc.SetMaxDynamicTableSizeLimit(uint32(tableSize))
+		}
+		return h.framer.WriteSettingsAck()
+	})
+}
+
+func (h *h2Conn) onHeaders(f *http2.MetaHeadersFrame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.streams[f.StreamID]
+	if st == nil {
+		return // canceled
+	}
+	if st.headerLen == 0 { // trailers are otherwise ignored
+		status := f.PseudoValue("status")
+		code, _ := strconv.Atoi(status)
+		if code >= 100 && code < 200 {
+			return // informational, wait for the real response
+		}
+		st.code = code
+		if st.timed {
+			st.headersAt = time.Now()
+		}
+		b := append(h.scratch[:0], "HTTP/2.0 "...)
+		b = append(b, status...)
+		b = append(b, ' ')
+		b = append(b, http.StatusText(code)...)
+		b = append(b, '\r', '\n')
+		for _, hf := range f.RegularFields() {
+			b = append(b, hf.Name...)
+			b = append(b, ':', ' ')
+			b = append(b, hf.Value...)
+			b = append(b, '\r', '\n')
+		}
+		b = append(b, '\r', '\n')
+		h.scratch = b
+		st.add(b)
+		st.headerLen = st.size
+	}
+	if f.StreamEnded() {
+		h.finish(st, nil)
+	}
+}
+
+func (h *h2Conn) onData(f *http2.DataFrame) {
+	var connUpdate, streamUpdate uint32
+	h.mu.Lock()
+	h.recvUnacked += f.Length
+	if h.recvUnacked >= h2Window/2 {
+		connUpdate, h.recvUnacked = h.recvUnacked, 0
+	}
+	st := h.streams[f.StreamID]
+	if st != nil {
+		st.add(f.Data())
+		if f.StreamEnded() {
+			h.finish(st, nil)
+		} else if st.recvUnacked += f.Length; st.recvUnacked >= h2Window/2 {
+			streamUpdate, st.recvUnacked = st.recvUnacked, 0
+		}
+	}
+	h.mu.Unlock()
+	if connUpdate == 0 && streamUpdate == 0 {
+		return
+	}
+	_ = h.write(func() error {
+		if connUpdate > 0 {
+			if err := h.framer.WriteWindowUpdate(0, connUpdate); err != nil {
+				return err
+			}
+		}
+		if streamUpdate > 0 {
+			return h.framer.WriteWindowUpdate(f.StreamID, streamUpdate)
+		}
+		return nil
+	})
+}
+
+// roundTrip sends the request on a new stream and waits for the response (or timeout).
+func (h *h2Conn) roundTrip(st *h2Stream, fields []hpack.HeaderField, body []byte) error {
+	timer := time.AfterFunc(h.timeout, func() {
+		h.mu.Lock()
+		st.expired = true
+		h.cond.Broadcast()
+		h.mu.Unlock()
+	})
+	defer timer.Stop()
+	// Wait for a stream slot, still free once both locks are held (or wait again)
+	for {
+		h.mu.Lock()
+		for !h.closed && !st.expired && uint32(len(h.streams)) >= h.maxStreams {
+			h.cond.Wait()
+		}
+		h.mu.Unlock()
+		h.wmu.Lock()
+		h.mu.Lock()
+		if !h.closed && st.expired {
+			// timed out waiting for a slot: report it, the connection itself is fine
+			h.mu.Unlock()
+			h.wmu.Unlock()
+			return errH2Timeout
+		}
+		if h.closed || h.nextID > h2MaxStreamID {
+			h.closed = true
+			h.mu.Unlock()
+			h.wmu.Unlock()
+			return errH2Unavailable
+		}
+		if uint32(len(h.streams)) < h.maxStreams {
+			break
+		}
+		h.mu.Unlock()
+		h.wmu.Unlock()
+	}
+	st.id = h.nextID
+	h.nextID += 2
+	st.sendWindow = h.peerWindow
+	h.streams[st.id] = st
+	maxFrame := int(h.maxFrame)
+	h.mu.Unlock()
+	h.hbuf.Reset()
+	for _, f := range fields {
+		_ = h.henc.WriteField(f)
+	}
+	_ = h.conn.SetWriteDeadline(time.Now().Add(h.timeout))
+	block := h.hbuf.Bytes()
+	frag := block[:minInt(len(block), maxFrame)]
+	block = block[len(frag):]
+	err := h.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID: st.id, BlockFragment: frag, EndStream: len(body) == 0, EndHeaders: len(block) == 0,
+	})
+	for err == nil && len(block) > 0 {
+		frag = block[:minInt(len(block), maxFrame)]
+		block = block[len(frag):]
+		err = h.framer.WriteContinuation(st.id, len(block) == 0, frag)
+	}
+	h.wmu.Unlock()
+	if err != nil {
+		h.fail(err)
+		return err
+	}
+	for len(body) > 0 {
+		h.mu.Lock()
+		for !st.ended && !st.expired && (h.sendWindow <= 0 || st.sendWindow <= 0) {
+			h.cond.Wait()
+		}
+		if st.ended || st.expired {
+			h.mu.Unlock()
+			break
+		}
+		n := minInt(len(body), maxFrame, int(h.sendWindow), int(st.sendWindow))
+		h.sendWindow -= int32(n)
+		st.sendWindow -= int32(n)
+		h.mu.Unlock()
+		data := body[:n]
+		body = body[n:]
+		if err = h.write(func() error { return h.framer.WriteData(st.id, len(body) == 0, data) }); err != nil {
+			return err
+		}
+	}
+	// Wait for the response
+	h.mu.Lock()
+	for !st.ended && !st.expired {
+		h.cond.Wait()
+	}
+	if st.ended {
+		h.mu.Unlock()
+		return st.err
+	}
+	// timed out: cancel the stream
+	h.finish(st, errH2Timeout)
+	h.mu.Unlock()
+	_ = h.write(func() error { return h.framer.WriteRSTStream(st.id, http2.ErrCodeCancel) })
+	return errH2Timeout
+}
+
+// h2Request converts the (rendered) http/1.1 request into http/2 header fields and body.
+func h2Request(req []byte, scheme string) ([]hpack.HeaderField, []byte) {
+	end := bytes.Index(req, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(req)
+	}
+	lines := strings.Split(string(req[:end]), "\r\n")
+	body := req[minInt(end+4, len(req)):]
+	method, rest, _ := strings.Cut(lines[0], " ")
+	path := rest
+	if idx := strings.LastIndex(rest, " "); idx >= 0 {
+		path = rest[:idx]
+	}
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: method}, {Name: ":scheme", Value: scheme}, {Name: ":authority"}, {Name: ":path", Value: path},
+	}
+	for _, l := range lines[1:] {
+		name, value, _ := strings.Cut(l, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		switch name {
+		case "host":
+			fields[2].Value = value
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			// connection specific headers are not allowed in http/2
+		default:
+			fields = append(fields, hpack.HeaderField{Name: name, Value: value})
+		}
+	}
+	return fields, body
+}
+
+// h2Connection returns the (possibly shared) connection to use, nil on error, making a new
+// one if needed. When the server doesn't negotiate h2, the client switches to http/1.1 and the
+// new socket is in c.socket.
+func (c *FastClient) h2Connection(ctx context.Context) *h2Conn {
+	g := c.h2group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conn != nil {
+		if g.conn.usable() {
+			return g.conn
+		}
+		g.conn.retire()
+		g.conn = nil
+	}
+	socket := c.connect(ctx)
+	if socket == nil {
+		return nil
+	}
+	if tlsConn, ok := socket.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		log.S(log.Warning, "Server did not negotiate h2, using http/1.1", log.Str("host", c.host),
+			log.Attr("thread", c.id), log.Attr("run", c.runID))
+		c.h2 = false
+		c.socket = socket
+		return nil
+	}
+	conn, err := newH2Conn(socket, c.reqTimeout)
+	if err != nil {
+		log.S(log.Error, "Unable to setup http/2 connection", log.Attr("dest", c.dest), log.Attr("err", err),
+			log.Attr("thread", c.id), log.Attr("run", c.runID))
+		return nil
+	}
+	g.conn = conn
+	return conn
+}
+
+// fetchH2 is the http/2 version of StreamFetch. Returns false if the client switched to http/1.1.
+func (c *FastClient) fetchH2(ctx context.Context) bool {
+	fields, body := c.h2Fields, c.h2Body
+	if c.headTemplate != nil || c.cookie != "" {
+		fields, body = h2Request(c.nextRequest(), c.h2Scheme)
+	}
+	for retry := 0; retry < 2; retry++ {
+		conn := c.h2Connection(ctx)
+		if conn == nil {
+			return c.h2
+		}
+		st := &h2Stream{buf: c.buffer, timed: c.info != nil}
+		err := conn.roundTrip(st, fields, body)
+		c.streamCount++
+		if errors.Is(err, errH2Unavailable) {
+			log.LogVf("[%d] http/2 stream refused/unavailable, retrying on a new connection", c.id)
+			c.errorCount++
+			continue
+		}
+		c.size = int64(st.size)
+		c.headerLen = uint(st.headerLen)
+		if st.timed && !st.headersAt.IsZero() {
+			c.info.FirstByte = st.headersAt.Sub(c.info.Start)
+		}
+		if err != nil {
+			log.S(log.Error, "http/2 request error", log.Attr("err", err), log.Attr("dest", c.dest), log.Str("url", c.url),
+				log.Attr("thread", c.id), log.Attr("run", c.runID))
+			return true
+		}
+		c.code = st.code
+		if st.dropped > 0 {
+			log.S(log.Error, "Buffer too small for data, increase -httpbufferkb to get all the data",
+				log.Attr("size", st.size+st.dropped), log.Attr("thread", c.id), log.Attr("run", c.runID))
+		}
+		if !codeIsOK(c.code) && c.logErrors {
+			log.S(log.Warning, "Non ok http code", log.Attr("code", c.code), log.Attr("thread", c.id), log.Attr("run", c.runID))
+		}
+		return true
+	}
+	return true
+}
+
+// streamCounter is implemented by the FastClient.
+type streamCounter interface {
+	// h2StreamCount returns the number of http/2 streams (requests) made, 0 when not using h2.
+	h2StreamCount() int64
+}
+
+func (c *FastClient) h2StreamCount() int64 {
+	return c.streamCount
+}
+
+func minInt(first int, others ...int) int {
+	res := first
+	for _, v := range others {
+		if v < res {
+			res = v
+		}
+	}
+	return res
+}
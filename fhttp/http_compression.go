@@ -0,0 +1,107 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Fast client side decoding of compressed (gzip, deflate) responses.
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// AcceptEncoding is what the fast client requests when Compression is on
+// (brotli and zstd would need dependencies outside of the standard library).
+const AcceptEncoding = "gzip, deflate"
+
+// decoder is the fast client's (reused) decompression state.
+type decoder struct {
+	gzip    *gzip.Reader
+	reader  bytes.Reader
+	buffer  bytes.Buffer
+	decoded []byte // decoded body of the last response, nil when not encoded (or not decoding)
+}
+
+// decode decompresses the body of the last response when it has a gzip or
+// deflate Content-Encoding. Sets the code to DecompressionError when that fails.
+func (c *FastClient) decode() {
+	d := c.decoder
+	d.decoded = nil
+	if c.code <= 0 || c.headerLen == 0 {
+		return
+	}
+	encoding, found := c.responseHeader("Content-Encoding")
+	if !found {
+		return
+	}
+	body := c.rawBody()
+	if len(body) == 0 {
+		return
+	}
+	d.reader.Reset(body)
+	var r io.Reader
+	var err error
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		if d.gzip == nil {
+			d.gzip, err = gzip.NewReader(&d.reader)
+		} else {
+			err = d.gzip.Reset(&d.reader)
+		}
+		r = d.gzip
+	case "deflate":
+		// Supposed to be zlib wrapped but some servers send raw deflate.
+		if len(body) >= 2 && body[0]&0x0f == 8 && (uint16(body[0])<<8|uint16(body[1]))%31 == 0 {
+			r, err = zlib.NewReader(&d.reader)
+		} else {
+			r = flate.NewReader(&d.reader)
+		}
+	case "identity":
+		return
+	default:
+		log.S(log.Warning, "Unsupported content encoding, not decoding", log.Str("encoding", encoding),
+			log.Attr("thread", c.id), log.Attr("run", c.runID))
+		return
+	}
+	d.buffer.Reset()
+	if err == nil {
+		_, err = d.buffer.ReadFrom(r)
+	}
+	d.decoded = d.buffer.Bytes()
+	if err == nil {
+		return
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) && c.size >= int64(len(c.buffer)) {
+		log.LogVf("[%d] Partial decoding of %s body truncated by the buffer size", c.id, encoding)
+		return
+	}
+	log.S(log.Warning, "Unable to decode response", log.Str("encoding", encoding), log.Attr("err", err),
+		log.Attr("thread", c.id), log.Attr("run", c.runID))
+	c.code = DecompressionError
+}
+
+// decodedSize is the size of the last response with its body decoded.
+func (c *FastClient) decodedSize() int64 {
+	if c.decoder == nil || c.decoder.decoded == nil {
+		return c.size
+	}
+	return int64(c.headerLen) + int64(len(c.decoder.decoded))
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Connections lifetime, requests per connection and who closed them.
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/stats"
+)
+
+// connectionStats are the lifetime and number of requests of a client's closed connections,
+// and whether the server or the client initiated the close.
+type connectionStats struct {
+	mu           sync.Mutex // the std client's connections are closed by the transport's go routines
+	lifetime     *stats.Histogram
+	requests     *stats.Histogram
+	serverCloses int64
+	clientCloses int64
+}
+
+func newConnectionStats(resolution float64) *connectionStats {
+	return &connectionStats{
+		lifetime: stats.NewHistogram(0, resolution),
+		requests: stats.NewHistogram(0, 1),
+	}
+}
+
+// record accounts for a connection opened at start which served requests and was closed,
+// by the server if serverClose.
+func (s *connectionStats) record(start time.Time, requests int64, serverClose bool) {
+	s.mu.Lock()
+	s.lifetime.Record(time.Since(start).Seconds())
+	s.requests.Record(float64(requests))
+	if serverClose {
+		s.serverCloses++
+	} else {
+		s.clientCloses++
+	}
+	s.mu.Unlock()
+}
+
+// transfer merges the src stats into s and resets src.
+func (s *connectionStats) transfer(src *connectionStats) {
+	src.mu.Lock()
+	s.mu.Lock()
+	s.lifetime.Transfer(src.lifetime)
+	s.requests.Transfer(src.requests)
+	s.serverCloses += src.serverCloses
+	s.clientCloses += src.clientCloses
+	src.serverCloses, src.clientCloses = 0, 0
+	s.mu.Unlock()
+	src.mu.Unlock()
+}
+
+// connectionStatsGetter is implemented by both clients.
+type connectionStatsGetter interface {
+	// closedConnectionStats returns the stats of the connections closed so far (all of them after Close()).
+	closedConnectionStats() *connectionStats
+}
+
+func (c *FastClient) closedConnectionStats() *connectionStats {
+	return c.connStats
+}
+
+func (c *Client) closedConnectionStats() *connectionStats {
+	return c.connStats
+}
+
+// socketClosed records the fast client's current connection, just closed (by the server if serverClose).
+func (c *FastClient) socketClosed(serverClose bool) {
+	c.connStats.record(c.connStart, c.connRequests, serverClose)
+}
+
+// trackedConn is a std client connection recording its stats when closed: a close following
+// a read error (typically EOF) or a Connection: close response is the server's, any other the client's.
+type trackedConn struct {
+	net.Conn
+	stats       *connectionStats
+	start       time.Time
+	mu          sync.Mutex
+	requests    int64
+	serverClose bool
+	closed      bool
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && !isTimeout(err) {
+		c.mu.Lock()
+		c.serverClose = true
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.stats.record(c.start, c.requests, c.serverClose)
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) addRequest() {
+	c.mu.Lock()
+	c.requests++
+	c.mu.Unlock()
+}
+
+// closedByServer marks the connection as closed by the server (Connection: close response),
+// fixing up the stats if the transport already closed it.
+func (c *trackedConn) closedByServer() {
+	c.mu.Lock()
+	if c.closed && !c.serverClose {
+		c.stats.mu.Lock()
+		c.stats.clientCloses--
+		c.stats.serverCloses++
+		c.stats.mu.Unlock()
+	}
+	c.serverClose = true
+	c.mu.Unlock()
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// connTrace returns the hooks counting the requests made on each of the std client's
+// trackedConn, the last one being kept in c.lastConn.
+func (c *Client) connTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			if tc, ok := conn.(*tls.Conn); ok {
+				conn = tc.NetConn()
+			}
+			if t, ok := conn.(*trackedConn); ok {
+				t.addRequest()
+				c.lastConn = t
+			}
+		},
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Echo server transport level fault injection (fault=).
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"fortio.org/fortio/stats"
+	"fortio.org/log"
+)
+
+// Transport level faults the echo server can inject with fault=.
+const (
+	// FaultReset resets (tcp RST) the connection instead of responding.
+	FaultReset = "reset"
+	// FaultResetMid resets the connection after sending the headers and half of the body.
+	FaultResetMid = "reset-mid"
+	// FaultTruncate sends half of the body, shorter than the Content-Length, and closes the connection.
+	FaultTruncate = "truncate"
+	// FaultBadHeader sends a malformed header line.
+	FaultBadHeader = "bad-header"
+	// FaultBadChunk sends the body with an invalid chunked encoding.
+	FaultBadChunk = "bad-chunk"
+	// FaultHang sends the headers and then nothing, until the client gives up.
+	FaultHang = "hang"
+	// FaultClose closes the connection without responding.
+	FaultClose = "close"
+)
+
+var faults = []string{FaultReset, FaultResetMid, FaultTruncate, FaultBadHeader, FaultBadChunk, FaultHang, FaultClose}
+
+func validFault(fault string) bool {
+	if containsString(faults, fault) {
+		return true
+	}
+	log.Warnf("Unknown fault %q, should be one of %v", fault, faults)
+	return false
+}
+
+// generateFault from string, format: fault=reset for 100% connection resets,
+// fault="reset:10,hang:0.5" for 10% resets, 0.5% hangs and 89.5% normal responses ("").
+func generateFault(fault string) string {
+	if len(fault) == 0 {
+		return ""
+	}
+	lst := strings.Split(fault, ",")
+	log.Debugf("Parsing fault %s -> %v", fault, lst)
+	// Simple non probabilistic case:
+	if len(lst) == 1 && !strings.ContainsRune(fault, ':') {
+		if !validFault(fault) {
+			return ""
+		}
+		return fault
+	}
+	weights := make([]float32, len(lst))
+	names := make([]string, len(lst))
+	lastPercent := float64(0)
+	for i, entry := range lst {
+		l2 := strings.Split(entry, ":")
+		if len(l2) != 2 {
+			log.Warnf("Should have exactly 1 : in fault list %s -> %v", fault, entry)
+			return ""
+		}
+		if !validFault(l2[0]) {
+			return ""
+		}
+		percStr := removeTrailingPercent(l2[1])
+		p, err := strconv.ParseFloat(percStr, 32)
+		if err != nil || p < 0 || p > 100 {
+			log.Warnf("Percentage is not a [0. - 100.] number in %v -> %v : %v %f", fault, percStr, err, p)
+			return ""
+		}
+		lastPercent += p
+		// Round() needed to cover 'exactly' 100% and not more or less because of rounding errors
+		p32 := float32(stats.Round(lastPercent))
+		if p32 > 100. {
+			log.Warnf("Sum of percentage is greater than 100 in %v %f %f %f", fault, lastPercent, p, p32)
+			return ""
+		}
+		weights[i] = p32
+		names[i] = l2[0]
+	}
+	res := 100. * rand.Float32() //nolint:gosec // we want fast not crypto
+	for i, v := range weights {
+		if res <= v {
+			log.Debugf("[0.-100.[ for %s roll %f got #%d -> %s", fault, res, i, names[i])
+			return names[i]
+		}
+	}
+	log.Debugf("[0.-100.[ for %s roll %f no hit, no fault", fault, res)
+	return ""
+}
+
+// injectFault replies to the request with the fault instead of a normal response with status and body.
+// For http/1.x the connection is hijacked to misbehave below http, for h2 all faults but hang reset the stream.
+func injectFault(w http.ResponseWriter, r *http.Request, fault string, status int, body []byte) {
+	log.LogVf("Injecting %s fault for %s %v", fault, r.RemoteAddr, r.URL)
+	recordFault(fault)
+	hj, ok := w.(http.Hijacker)
+	if r.ProtoMajor >= 2 || !ok {
+		if fault == FaultHang {
+			w.WriteHeader(status)
+			Flush(w)
+			<-r.Context().Done()
+			return
+		}
+		panic(http.ErrAbortHandler) // resets the stream without logging
+	}
+	conn, bw, err := hj.Hijack()
+	if err != nil {
+		log.Errf("Unable to hijack connection for fault %s: %v", fault, err)
+		return
+	}
+	defer conn.Close()
+	head := func(extraHeaders string) {
+		_, _ = fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+		_ = w.Header().Write(bw)
+		_, _ = bw.WriteString(extraHeaders + "\r\n")
+	}
+	half := body[:len(body)/2]
+	switch fault {
+	case FaultReset:
+		resetConn(conn)
+		return
+	case FaultClose:
+		return
+	case FaultResetMid:
+		head(fmt.Sprintf("Content-Length: %d\r\n", len(body)))
+		_, _ = bw.Write(half)
+		_ = bw.Flush()
+		resetConn(conn)
+		return
+	case FaultTruncate:
+		head(fmt.Sprintf("Content-Length: %d\r\n", len(body)+1)) // +1 so empty bodies are also truncated
+		_, _ = bw.Write(half)
+	case FaultBadHeader:
+		head(fmt.Sprintf("Content-Length: %d\r\nThis is not a valid header line\r\n", len(body)))
+		_, _ = bw.Write(body)
+	case FaultBadChunk:
+		head("Transfer-Encoding: chunked\r\n")
+		_, _ = fmt.Fprintf(bw, "%xzz\r\n", len(body)+1) // not hex
+		_, _ = bw.Write(body)
+		_, _ = bw.WriteString("\r\n0\r\n\r\n")
+	case FaultHang:
+		head(fmt.Sprintf("Content-Length: %d\r\n", len(body)))
+		_ = bw.Flush()
+		_, _ = io.Copy(io.Discard, bw) // until the client closes the connection
+		return
+	}
+	if err = bw.Flush(); err != nil {
+		log.LogVf("Error writing %s fault to %v: %v", fault, r.RemoteAddr, err)
+	}
+}
+
+// resetConn closes conn with a tcp RST instead of the normal FIN.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = conn.Close()
+}
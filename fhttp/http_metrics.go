@@ -0,0 +1,309 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Server side (echo, debug, proxy, grpc ping...) request metrics in prometheus format.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/dflag"
+)
+
+// ServerMetrics enables the recording of the servers requests metrics (connections are always counted).
+var ServerMetrics = dflag.NewBool(false,
+	"Record the echo, debug, proxy and grpc ping servers requests metrics for /debug/metrics. dynamic flag.")
+
+// MaxMetricsPaths is the maximum number of distinct path label values, further
+// paths are counted as "other" (as the echo server accepts any path).
+var MaxMetricsPaths = 100
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration histogram buckets.
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	server, method, path, status string
+}
+
+type latencyKey struct {
+	server, path string
+}
+
+type latencyHistogram struct {
+	counts []int64 // per latencyBuckets, non cumulative, the last one being +Inf
+	sum    float64
+	count  int64
+}
+
+// serverMetrics are the metrics of all the servers of this process.
+type serverMetrics struct {
+	mu          sync.Mutex
+	requests    map[requestKey]int64
+	latencies   map[latencyKey]*latencyHistogram
+	received    map[string]int64
+	sent        map[string]int64
+	connections map[string]int64
+	faults      map[string]int64
+	paths       map[string]bool
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:    make(map[requestKey]int64),
+		latencies:   make(map[latencyKey]*latencyHistogram),
+		received:    make(map[string]int64),
+		sent:        make(map[string]int64),
+		connections: make(map[string]int64),
+		faults:      make(map[string]int64),
+		paths:       make(map[string]bool),
+	}
+}
+
+var srvMetrics = newServerMetrics()
+
+// ResetServerMetrics clears all the server metrics.
+func ResetServerMetrics() {
+	m := newServerMetrics()
+	srvMetrics.mu.Lock()
+	m.connections = srvMetrics.connections // still open
+	srvMetrics.requests, srvMetrics.latencies = m.requests, m.latencies
+	srvMetrics.received, srvMetrics.sent = m.received, m.sent
+	srvMetrics.faults, srvMetrics.paths = m.faults, m.paths
+	srvMetrics.mu.Unlock()
+}
+
+// RecordServerRequest records a request served by server with its method (or "grpc"), path
+// (or grpc method), status, duration and received and sent (body) bytes.
+// Nothing is recorded unless ServerMetrics is on.
+func RecordServerRequest(server, method, path, status string, d time.Duration, in, out int64) {
+	if !ServerMetrics.Get() {
+		return
+	}
+	m := srvMetrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.paths[path] {
+		if len(m.paths) >= MaxMetricsPaths {
+			path = "other"
+		} else {
+			m.paths[path] = true
+		}
+	}
+	m.requests[requestKey{server, method, path, status}]++
+	lk := latencyKey{server, path}
+	h := m.latencies[lk]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]int64, len(latencyBuckets)+1)}
+		m.latencies[lk] = h
+	}
+	s := d.Seconds()
+	h.counts[sort.SearchFloat64s(latencyBuckets, s)]++
+	h.sum += s
+	h.count++
+	m.received[server] += in
+	m.sent[server] += out
+}
+
+// RecordServerConnection adds delta (1 when opening, -1 when closing) to the server's active connections.
+func RecordServerConnection(server string, delta int64) {
+	srvMetrics.mu.Lock()
+	srvMetrics.connections[server] += delta
+	srvMetrics.mu.Unlock()
+}
+
+// recordFault counts an injected fault (fault= ones, rate limiting and stateful failures).
+func recordFault(fault string) {
+	if !ServerMetrics.Get() {
+		return
+	}
+	srvMetrics.mu.Lock()
+	srvMetrics.faults[fault]++
+	srvMetrics.mu.Unlock()
+}
+
+// connStateMetrics is the http.Server ConnState hook maintaining the server's active connections.
+func connStateMetrics(server string) func(net.Conn, http.ConnState) {
+	return func(_ net.Conn, state http.ConnState) {
+		switch state { //nolint:exhaustive // only the start and end states matter
+		case http.StateNew:
+			RecordServerConnection(server, 1)
+		case http.StateHijacked, http.StateClosed:
+			RecordServerConnection(server, -1)
+		}
+	}
+}
+
+// metricsResponseWriter captures the status and size of the response, keeping the
+// Flusher interface of the underlying ResponseWriter (use writer() to also keep Hijacker).
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	size     int64
+	hijacked bool
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *metricsResponseWriter) Flush() {
+	Flush(w.ResponseWriter)
+}
+
+// writer returns w as a http.Hijacker only when the underlying ResponseWriter is one
+// (not for http/2.0 where e.g. the FetcherHandler must tell to use fetch2 instead).
+func (w *metricsResponseWriter) writer() http.ResponseWriter {
+	if _, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijackerResponseWriter{w}
+	}
+	return w
+}
+
+// hijackerResponseWriter is the metricsResponseWriter of a http.Hijacker.
+type hijackerResponseWriter struct {
+	*metricsResponseWriter
+}
+
+func (w hijackerResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// metricsHandler returns the handler recording the server metrics of the requests handled by h.
+func metricsHandler(server string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ServerMetrics.Get() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		mw := &metricsResponseWriter{ResponseWriter: w}
+		var body *countingReader
+		if r.Body != nil {
+			body = &countingReader{ReadCloser: r.Body}
+			r.Body = body
+		}
+		defer func() {
+			status := "hijacked" // e.g. for faults, we don't know what was sent
+			if !mw.hijacked {
+				if mw.status == 0 {
+					mw.status = http.StatusOK // nothing written
+				}
+				status = strconv.Itoa(mw.status)
+			}
+			in := int64(0)
+			if body != nil {
+				in = body.n
+			}
+			RecordServerRequest(server, r.Method, r.URL.Path, status, time.Since(start), in, mw.size)
+		}()
+		h.ServeHTTP(mw.writer(), r)
+	})
+}
+
+// WriteServerMetrics writes the server metrics in prometheus text format.
+func WriteServerMetrics(w io.Writer) {
+	m := srvMetrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("# HELP fortio_server_requests_total Number of requests served\n")
+	b.WriteString("# TYPE fortio_server_requests_total counter\n")
+	reqKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		reqKeys = append(reqKeys, k)
+	}
+	sort.Slice(reqKeys, func(i, j int) bool {
+		a, c := reqKeys[i], reqKeys[j]
+		return a.server+"\n"+a.path+"\n"+a.method+"\n"+a.status < c.server+"\n"+c.path+"\n"+c.method+"\n"+c.status
+	})
+	for _, k := range reqKeys {
+		fmt.Fprintf(&b, "fortio_server_requests_total{server=%q,method=%q,path=%q,status=%q} %d\n",
+			k.server, k.method, k.path, k.status, m.requests[k])
+	}
+	b.WriteString("# HELP fortio_server_request_duration_seconds Requests duration\n")
+	b.WriteString("# TYPE fortio_server_request_duration_seconds histogram\n")
+	latKeys := make([]latencyKey, 0, len(m.latencies))
+	for k := range m.latencies {
+		latKeys = append(latKeys, k)
+	}
+	sort.Slice(latKeys, func(i, j int) bool {
+		return latKeys[i].server+"\n"+latKeys[i].path < latKeys[j].server+"\n"+latKeys[j].path
+	})
+	for _, k := range latKeys {
+		h := m.latencies[k]
+		labels := fmt.Sprintf("server=%q,path=%q", k.server, k.path)
+		cumulative := int64(0)
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "fortio_server_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, cumulative)
+		}
+		fmt.Fprintf(&b, "fortio_server_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(&b, "fortio_server_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(&b, "fortio_server_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+	writeMetricsMap(&b, "fortio_server_received_bytes_total", "Request body bytes received", "counter", "server", m.received)
+	writeMetricsMap(&b, "fortio_server_sent_bytes_total", "Response body bytes sent", "counter", "server", m.sent)
+	writeMetricsMap(&b, "fortio_server_active_connections", "Number of open connections", "gauge", "server", m.connections)
+	writeMetricsMap(&b, "fortio_server_faults_total", "Number of injected faults", "counter", "type", m.faults)
+	_, _ = io.WriteString(w, b.String())
+}
+
+func writeMetricsMap(b *strings.Builder, name, help, typ, label string, values map[string]int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Client side (egress) proxy support: HTTP CONNECT tunnels, absolute-form
+// requests through http proxies and SOCKS5.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/stats"
+	"golang.org/x/net/proxy"
+)
+
+// parseProxy parses and validates a proxy url (http:// or socks5://, with optional user:password@).
+func parseProxy(proxyURL string) (*url.URL, error) {
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "http://" + proxyURL
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "socks5", "socks5h":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1080")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expecting http or socks5", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing proxy host in %q", proxyURL)
+	}
+	return u, nil
+}
+
+// absoluteForm is true when requests are sent as is to the (http) proxy instead of through a tunnel.
+func absoluteForm(p *url.URL, https bool) bool {
+	return p != nil && p.Scheme == "http" && !https
+}
+
+// proxyAuthorization returns the Proxy-Authorization header value for the proxy's user info, if any.
+func proxyAuthorization(p *url.URL) string {
+	if p == nil || p.User == nil {
+		return ""
+	}
+	password, _ := p.User.Password()
+	return generateBase64UserCredentials(p.User.Username() + ":" + password)
+}
+
+// hostPort returns host:port for the target, replacing scheme "ports" by their numeric values.
+func hostPort(hostname, port string) string {
+	switch port {
+	case "http", "":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+// dialProxy connects to the proxy at addr and, unless it's an absolute-form http proxy,
+// sets up the tunnel to target (host:port).
+func dialProxy(ctx context.Context, d *net.Dialer, p *url.URL, addr, target string, https bool) (net.Conn, error) {
+	if p.Scheme != "http" {
+		var auth *proxy.Auth
+		if p.User != nil {
+			password, _ := p.User.Password()
+			auth = &proxy.Auth{User: p.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", addr, auth, d)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil || absoluteForm(p, https) {
+		return conn, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(d.Timeout))
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if auth := proxyAuthorization(p); auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", target, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected %d bytes from proxy after CONNECT", br.Buffered())
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyStatsGetter is implemented by both clients.
+type proxyStatsGetter interface {
+	// proxyConnectStats returns the proxy connection (and tunnel setup) time histogram, nil when not using a proxy.
+	proxyConnectStats() *stats.Histogram
+}
+
+func (c *FastClient) proxyConnectStats() *stats.Histogram {
+	return c.proxyStats
+}
+
+func (c *Client) proxyConnectStats() *stats.Histogram {
+	return c.proxyStats
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Echo server token bucket rate limiting, replying 429 with Retry-After and RateLimit-* headers.
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/dflag"
+	"fortio.org/log"
+)
+
+var (
+	// EchoRateLimit is the echo server's token bucket "qps[:burst]" limit (burst defaults to qps), empty for none.
+	EchoRateLimit = dflag.New("",
+		"Echo server rate limit `qps[:burst]`, exceeding requests get a 429 with Retry-After. dynamic flag.").
+		WithValidator(func(s string) error {
+			_, _, err := ParseRateLimit(s)
+			return err
+		})
+	// EchoRateLimitKey is the scope of the EchoRateLimit: empty or "global" for a single bucket,
+	// "path" for one per path, "ip" for one per client ip or else the name of a header identifying clients.
+	EchoRateLimitKey = dflag.New("",
+		"Echo server rate limit scope: global (default), path, ip or a client key header name. dynamic flag.")
+)
+
+//nolint:gochecknoinits // needed here (the notifiers refer to both flags)
+func init() {
+	EchoRateLimit.WithSyncNotifier(func(_, _ string) { updateEchoRateLimiter() })
+	EchoRateLimitKey.WithSyncNotifier(func(_, _ string) { updateEchoRateLimiter() })
+}
+
+var echoRateLimiter atomic.Value // *rateLimiter, nil when not rate limiting
+
+// MaxRateLimitBuckets is the maximum number of token buckets (for the ip and header scopes),
+// further keys share a single bucket.
+var MaxRateLimitBuckets = 10000
+
+// ParseRateLimit parses "qps[:burst]", 0, 0 for the empty string.
+func ParseRateLimit(s string) (qps float64, burst int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	qpsStr, burstStr, hasBurst := strings.Cut(s, ":")
+	qps, err = strconv.ParseFloat(qpsStr, 64)
+	if err != nil || qps <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit qps %q, should be a positive number", qpsStr)
+	}
+	burst = int(math.Ceil(qps))
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst <= 0 {
+			return 0, 0, fmt.Errorf("invalid rate limit burst %q, should be a positive integer", burstStr)
+		}
+	}
+	return qps, burst, nil
+}
+
+// updateEchoRateLimiter (re)creates the rate limiter, with full buckets, from the current flags values.
+func updateEchoRateLimiter() {
+	qps, burst, _ := ParseRateLimit(EchoRateLimit.Get()) // already validated
+	if qps == 0 {
+		echoRateLimiter.Store((*rateLimiter)(nil))
+		log.Infof("Echo server rate limit off")
+		return
+	}
+	echoRateLimiter.Store(newRateLimiter(qps, float64(burst), EchoRateLimitKey.Get()))
+	log.Infof("Echo server rate limit %g qps, burst %d, scope %q", qps, burst, EchoRateLimitKey.Get())
+}
+
+// rateLimiter is a set of token buckets, one per key.
+type rateLimiter struct {
+	qps       float64
+	burst     float64
+	scope     string
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	other     *tokenBucket // shared by the keys beyond MaxRateLimitBuckets
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(qps, burst float64, scope string) *rateLimiter {
+	now := time.Now()
+	return &rateLimiter{
+		qps:     qps,
+		burst:   burst,
+		scope:   scope,
+		buckets: make(map[string]*tokenBucket),
+		other:   &tokenBucket{tokens: burst, last: now},
+	}
+}
+
+// full returns whether the bucket has refilled by now, making it the same as a new one.
+func (tb *tokenBucket) full(rl *rateLimiter, now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.tokens+now.Sub(tb.last).Seconds()*rl.qps >= rl.burst
+}
+
+// bucket returns the token bucket for key, creating it if needed. When there are already
+// MaxRateLimitBuckets, the full ones are evicted first (at most once per burst/qps, the time
+// it takes to refill one).
+func (rl *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if tb := rl.buckets[key]; tb != nil {
+		return tb
+	}
+	if len(rl.buckets) >= MaxRateLimitBuckets && now.Sub(rl.lastSweep).Seconds() >= rl.burst/rl.qps {
+		rl.lastSweep = now
+		for k, tb := range rl.buckets {
+			if tb.full(rl, now) {
+				delete(rl.buckets, k)
+			}
+		}
+		log.LogVf("Rate limit buckets after eviction of the full ones: %d", len(rl.buckets))
+	}
+	if len(rl.buckets) >= MaxRateLimitBuckets {
+		return rl.other
+	}
+	tb := &tokenBucket{tokens: rl.burst, last: now}
+	rl.buckets[key] = tb
+	return tb
+}
+
+// key returns the bucket key of the request for the limiter's scope.
+func (rl *rateLimiter) key(r *http.Request) string {
+	switch strings.ToLower(rl.scope) {
+	case "", "global":
+		return ""
+	case "path":
+		return r.URL.Path
+	case "ip":
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return host
+	default:
+		return r.Header.Get(rl.scope)
+	}
+}
+
+// take takes a token from the request's bucket, if available, and returns the tokens left
+// and the time until the next one (when not allowed) or until the bucket is full again.
+func (rl *rateLimiter) take(r *http.Request) (allowed bool, remaining float64, wait time.Duration) {
+	tb := rl.bucket(rl.key(r), time.Now())
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	tb.tokens = math.Min(rl.burst, tb.tokens+now.Sub(tb.last).Seconds()*rl.qps)
+	tb.last = now
+	if tb.tokens < 1 {
+		return false, tb.tokens, time.Duration((1 - tb.tokens) / rl.qps * float64(time.Second))
+	}
+	tb.tokens--
+	return true, tb.tokens, time.Duration((rl.burst - tb.tokens) / rl.qps * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// rateLimited applies the echo server rate limit, if any, to the request: it sets the RateLimit-*
+// headers and, when exceeded, replies 429 with a Retry-After header and returns true.
+func rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	rl, _ := echoRateLimiter.Load().(*rateLimiter)
+	if rl == nil {
+		return false
+	}
+	allowed, remaining, wait := rl.take(r)
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(int(rl.burst)))
+	h.Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	h.Set("RateLimit-Reset", ceilSeconds(wait))
+	if allowed {
+		return false
+	}
+	log.LogVf("Rate limiting %s %v, retry after %v", r.RemoteAddr, r.URL, wait)
+	recordFault("rate-limit")
+	h.Set("Retry-After", ceilSeconds(wait))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,403 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Replay of a recorded request log (JSONL or HAR) as a load test.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/stats"
+	"fortio.org/log"
+)
+
+// ReplayRequest is one request of a log to replay, see ReadReplay().
+type ReplayRequest struct {
+	// Optional name of the endpoint for the results breakdown, defaults to the method and path.
+	Name string `json:"name,omitempty"`
+	// Defaults to GET, or POST when there is a body.
+	Method string `json:"method,omitempty"`
+	// Absolute or relative to the run's URL.
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	// When the request was originally sent, for timed replays (see HTTPRunnerOptions.ReplaySpeed).
+	// When missing, the request is sent at the same time as the previous one.
+	Time time.Time `json:"time,omitempty"`
+}
+
+// EndpointResult is the per endpoint breakdown of a replay run.
+type EndpointResult struct {
+	RetCodes          map[int]int64
+	DurationHistogram *stats.HistogramData
+	durations         *stats.Histogram
+}
+
+// harFile is the subset of the HAR 1.2 format we use.
+type harFile struct {
+	Log *struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// ReadReplay reads requests to replay from either a HAR file (as exported by browsers
+// and proxies) or a JSONL file with one ReplayRequest json object per line.
+func ReadReplay(r io.Reader) ([]*ReplayRequest, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var har harFile
+	if json.Unmarshal(data, &har) == nil && har.Log != nil {
+		res := make([]*ReplayRequest, 0, len(har.Log.Entries))
+		for _, e := range har.Log.Entries {
+			rr := &ReplayRequest{Method: e.Request.Method, URL: e.Request.URL, Time: e.StartedDateTime}
+			if e.Request.PostData != nil {
+				rr.Body = e.Request.PostData.Text
+			}
+			for _, h := range e.Request.Headers {
+				if rr.Headers == nil {
+					rr.Headers = make(map[string]string)
+				}
+				rr.Headers[h.Name] = h.Value
+			}
+			res = append(res, rr)
+		}
+		if len(res) == 0 {
+			return nil, errors.New("no request to replay in HAR")
+		}
+		log.Infof("Read %d requests from HAR", len(res))
+		return res, nil
+	}
+	res := []*ReplayRequest{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		rr := &ReplayRequest{}
+		err = dec.Decode(rr)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("replay request #%d: %w", len(res)+1, err)
+		}
+		if rr.URL == "" {
+			return nil, fmt.Errorf("replay request #%d: missing url", len(res)+1)
+		}
+		res = append(res, rr)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no request to replay")
+	}
+	log.Infof("Read %d requests from JSONL", len(res))
+	return res, nil
+}
+
+// ReadReplayFile reads the requests to replay from the given HAR or JSONL file.
+func ReadReplayFile(fileName string) ([]*ReplayRequest, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		log.Errf("Unable to read replay file %s: %v", fileName, err)
+		return nil, err
+	}
+	defer f.Close()
+	res, err := ReadReplay(f)
+	if err != nil {
+		log.Errf("Unable to parse replay file %s: %v", fileName, err)
+	}
+	return res, err
+}
+
+// replayEntry is a ReplayRequest prepared for both clients (shared by all threads).
+type replayEntry struct {
+	name    string
+	key     string // scheme://host, one client per key per thread
+	options *HTTPOptions
+	fast    *FastClient // request bytes and templates for the fast client
+	std     *Client     // request and templates for the std client
+}
+
+// replayer is the shared state of a replay run.
+type replayer struct {
+	entries   []*replayEntry
+	offsets   []time.Duration // sorted original offsets of each slot, for timed replays
+	span      time.Duration   // duration of one pass over the log
+	speed     float64
+	next      int64 // atomic
+	start     time.Time
+	startOnce sync.Once
+}
+
+// replayClient is implemented by both FastClient and Client.
+type replayClient interface {
+	Fetcher
+	setReplayRequest(e *replayEntry)
+}
+
+func (c *FastClient) setReplayRequest(e *replayEntry) {
+	r := e.fast
+	c.url = e.options.URL
+	c.req, c.headTemplate, c.bodyTemplate, c.bodyLength, c.head = r.req, r.headTemplate, r.bodyTemplate, r.bodyLength, r.head
+}
+
+func (c *Client) setReplayRequest(e *replayEntry) {
+	r := e.std
+	c.url, c.req, c.body = r.url, r.req, r.body
+	c.pathTemplate, c.rawQueryTemplate, c.bodyTemplate, c.headerTemplates =
+		r.pathTemplate, r.rawQueryTemplate, r.bodyTemplate, r.headerTemplates
+}
+
+// replayOptions returns the options for the request r based on the run's options.
+func (h *HTTPOptions) replayOptions(r *ReplayRequest) (*HTTPOptions, *url.URL, error) {
+	base, err := url.Parse(h.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	u := base.ResolveReference(ref)
+	o := *h
+	o.initDone = false
+	o.https = false
+	o.MethodOverride = strings.ToUpper(r.Method)
+	o.Payload = []byte(r.Body)
+	o.ContentType = ""
+	o.PayloadReader = nil
+	o.DataWriter = nil
+	o.Pipeline = 0 // each request is different, no pipelining when replaying
+	if h.extraHeaders == nil {
+		h.InitHeaders()
+	}
+	o.extraHeaders = h.extraHeaders.Clone()
+	for k, v := range r.Headers {
+		switch strings.ToLower(k) {
+		case "host", "content-length", "connection":
+			// from the url and body, or set by the client
+		default:
+			if strings.HasPrefix(k, ":") {
+				continue // h2 pseudo headers in HAR
+			}
+			o.extraHeaders.Set(k, v)
+		}
+	}
+	o.Init(u.String())
+	return &o, u, nil
+}
+
+func newReplayer(o *HTTPRunnerOptions) (*replayer, error) {
+	n := len(o.Replay)
+	rp := &replayer{entries: make([]*replayEntry, n), offsets: make([]time.Duration, n), speed: o.ReplaySpeed}
+	// Requests without a time are sent at the time of the previous one (or the first timed one).
+	var prev time.Time
+	for _, r := range o.Replay {
+		if !r.Time.IsZero() {
+			prev = r.Time
+			break
+		}
+	}
+	times := make([]time.Time, n)
+	for i, r := range o.Replay {
+		eo, u, err := o.HTTPOptions.replayOptions(r)
+		if err != nil {
+			log.Errf("Bad replay url %q: %v", r.URL, err)
+			return nil, err
+		}
+		e := &replayEntry{name: r.Name, key: u.Scheme + "://" + u.Host, options: eo}
+		if e.name == "" {
+			path := u.Path
+			if path == "" {
+				path = "/"
+			}
+			e.name = eo.Method() + " " + path
+		}
+		if eo.DisableFastClient {
+			req, err := newHTTPRequest(eo)
+			if err != nil {
+				return nil, err
+			}
+			e.std = &Client{url: eo.URL, body: eo.Payload, req: req}
+			if err = e.std.parseTemplates(eo); err != nil {
+				return nil, err
+			}
+		} else {
+			e.fast = &FastClient{host: u.Host, http10: eo.HTTP10, id: eo.ID, runID: eo.UniqueID}
+			if err = e.fast.makeRequest(eo, u); err != nil {
+				return nil, err
+			}
+		}
+		rp.entries[i] = e
+		if !r.Time.IsZero() {
+			prev = r.Time
+		}
+		times[i] = prev
+	}
+	// Sort the entries by time, keeping the log order for same time ones, so out of order
+	// logs are replayed with the right timing. Offsets are relative to the earliest request.
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return times[order[i]].Before(times[order[j]]) })
+	entries := rp.entries
+	rp.entries = make([]*replayEntry, n)
+	for i, idx := range order {
+		rp.entries[i] = entries[idx]
+		rp.offsets[i] = times[idx].Sub(times[order[0]])
+	}
+	if n > 1 {
+		// so the next pass continues at the average inter arrival time
+		rp.span = rp.offsets[n-1] * time.Duration(n) / time.Duration(n-1)
+	}
+	if o.ReplayShuffle {
+		rand.Shuffle(n, func(i, j int) { rp.entries[i], rp.entries[j] = rp.entries[j], rp.entries[i] })
+	}
+	return rp, nil
+}
+
+// claim returns the slot number and entry of the next request to send.
+func (rp *replayer) claim() (int64, *replayEntry) {
+	i := atomic.AddInt64(&rp.next, 1) - 1
+	return i, rp.entries[i%int64(len(rp.entries))]
+}
+
+// clients creates, for thread id, the clients for each scheme and host of the replay
+// and returns the one for the first request (which the warmup will send).
+func (rp *replayer) clients(id int) (map[string]replayClient, Fetcher, error) {
+	res := make(map[string]replayClient)
+	for _, e := range rp.entries {
+		if _, found := res[e.key]; found {
+			continue
+		}
+		eo := *e.options
+		eo.ID = id
+		c, err := NewClient(&eo)
+		if err != nil {
+			return nil, nil, err
+		}
+		res[e.key] = c.(replayClient)
+	}
+	first := rp.entries[0]
+	c := res[first.key]
+	c.setReplayRequest(first)
+	return res, c, nil
+}
+
+// replayPacer replays the requests at their original timing (scaled by the speed factor).
+type replayPacer struct {
+	*HTTPRunnerResults
+}
+
+// WaitNext implements periodic.Pacer.
+func (p replayPacer) WaitNext(stop <-chan struct{}) bool {
+	rp := p.replay
+	rp.startOnce.Do(func() { rp.start = time.Now() })
+	i, e := rp.claim()
+	p.replayNext = e
+	n := int64(len(rp.entries))
+	target := rp.offsets[i%n] + time.Duration(i/n)*rp.span
+	wait := time.Until(rp.start.Add(time.Duration(float64(target) / rp.speed)))
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-stop:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// recordEndpoint records the result of one replayed request.
+func (httpstate *HTTPRunnerResults) recordEndpoint(e *replayEntry, code int, d time.Duration) {
+	ep := httpstate.endpoints[e.name]
+	if ep == nil {
+		ep = &EndpointResult{RetCodes: make(map[int]int64), durations: httpstate.endpointHistogram.Clone()}
+		httpstate.endpoints[e.name] = ep
+	}
+	ep.RetCodes[code]++
+	ep.durations.Record(d.Seconds())
+}
+
+// allClients returns the clients used by this thread, in a stable order.
+func (httpstate *HTTPRunnerResults) allClients() []Fetcher {
+	if httpstate.replayClients == nil {
+		return []Fetcher{httpstate.client}
+	}
+	keys := make([]string, 0, len(httpstate.replayClients))
+	for k := range httpstate.replayClients {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]Fetcher, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, httpstate.replayClients[k])
+	}
+	return res
+}
+
+// exportEndpoints computes and prints the per endpoint breakdown.
+func (httpstate *HTTPRunnerResults) exportEndpoints(out io.Writer, percentiles []float64) {
+	names := make([]string, 0, len(httpstate.endpoints))
+	for k := range httpstate.endpoints {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	httpstate.Endpoints = httpstate.endpoints
+	_, _ = fmt.Fprintf(out, "Endpoints breakdown:\n")
+	for _, k := range names {
+		ep := httpstate.endpoints[k]
+		ep.DurationHistogram = ep.durations.Export().CalcPercentiles(percentiles)
+		codes := make([]int, 0, len(ep.RetCodes))
+		for c := range ep.RetCodes {
+			codes = append(codes, c)
+		}
+		sort.Ints(codes)
+		var sb strings.Builder
+		for _, c := range codes {
+			fmt.Fprintf(&sb, " %d: %d", c, ep.RetCodes[c])
+		}
+		_, _ = fmt.Fprintf(out, "%s : count %d avg %.6g ms, codes%s\n",
+			k, ep.DurationHistogram.Count, 1000.*ep.DurationHistogram.Avg, sb.String())
+		if log.LogVerbose() {
+			ep.DurationHistogram.Print(out, k+" duration histogram (s)")
+		}
+	}
+}
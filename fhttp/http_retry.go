@@ -0,0 +1,164 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy configures the retries done by the http and grpc runners for each call,
+// like real clients do. The latency of a call includes all its attempts and the
+// backoffs in between, and only the result of the last attempt is counted in RetCodes.
+// This is independent of the fast client's transparent reconnect when a reused
+// keepalive socket turns out to be closed.
+type RetryPolicy struct {
+	// Total number of attempts, including the first one. 0 or 1 means no retries.
+	MaxAttempts int
+	// Codes to retry on: http status codes (SocketError, ie -1, for connection and other
+	// socket errors) or, for grpc, the status codes (e.g. 14 for Unavailable) and -1 for any error.
+	// Defaults to SocketError only when empty.
+	Codes []int `json:",omitempty"`
+	// Wait before the first retry, doubled for each subsequent one up to MaxBackoff (if set).
+	Backoff    time.Duration `json:",omitempty"`
+	MaxBackoff time.Duration `json:",omitempty"`
+}
+
+// NewRetryPolicy returns the policy for up to `retries` retries (nil when retries <= 0) on the
+// codes comma separated list (see ParseRetryCodes), with exponential backoff starting at backoff.
+func NewRetryPolicy(retries int, codes string, backoff, maxBackoff time.Duration) (*RetryPolicy, error) {
+	if retries <= 0 {
+		return nil, nil
+	}
+	p := &RetryPolicy{MaxAttempts: retries + 1, Backoff: backoff, MaxBackoff: maxBackoff}
+	var err error
+	p.Codes, err = ParseRetryCodes(codes)
+	return p, err
+}
+
+// ParseRetryCodes parses a comma separated list of codes to retry on: numbers,
+// ranges like "5xx" and "socket" (or "error") for SocketError.
+func ParseRetryCodes(s string) ([]int, error) {
+	var res []int
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		switch {
+		case c == "":
+			continue
+		case c == "socket" || c == "error":
+			res = append(res, SocketError)
+		case len(c) == 3 && strings.HasSuffix(c, "xx") && c[0] >= '1' && c[0] <= '5':
+			base := int(c[0]-'0') * 100
+			for code := base; code < base+100; code++ {
+				res = append(res, code)
+			}
+		default:
+			code, err := strconv.Atoi(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retry code %q", c)
+			}
+			res = append(res, code)
+		}
+	}
+	return res, nil
+}
+
+// Enabled returns true if the policy allows at least one retry. Ok to call on nil.
+func (p *RetryPolicy) Enabled() bool {
+	return p != nil && p.MaxAttempts > 1
+}
+
+// ShouldRetry returns whether a call whose attempt number `attempt` (starting at 1)
+// returned code should be attempted again.
+func (p *RetryPolicy) ShouldRetry(attempt, code int) bool {
+	if !p.Enabled() || attempt >= p.MaxAttempts {
+		return false
+	}
+	if len(p.Codes) == 0 {
+		return code == SocketError
+	}
+	for _, c := range p.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait sleeps for the backoff before the retry following attempt `attempt`.
+// Returns false if the context got canceled meanwhile.
+func (p *RetryPolicy) Wait(ctx context.Context, attempt int) bool {
+	d := p.Backoff
+	for i := 1; i < attempt && d > 0; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// RetryResults is the retry accounting of a run (when the RetryPolicy is enabled).
+type RetryResults struct {
+	// Total number of attempts (requests actually made), including the retries.
+	Attempts int64
+	// Calls that succeeded after at least one retry.
+	RetriedSuccesses int64
+	// Calls that were retried and still failed after their last attempt.
+	FinalFailures int64
+}
+
+// Record accounts for one call that took `attempts` attempts and whose final result is ok or not.
+func (r *RetryResults) Record(attempts int, ok bool) {
+	r.Attempts += int64(attempts)
+	if attempts <= 1 {
+		return
+	}
+	if ok {
+		r.RetriedSuccesses++
+	} else {
+		r.FinalFailures++
+	}
+}
+
+// Add aggregates the other (thread's) results into r.
+func (r *RetryResults) Add(o *RetryResults) {
+	r.Attempts += o.Attempts
+	r.RetriedSuccesses += o.RetriedSuccesses
+	r.FinalFailures += o.FinalFailures
+}
+
+// Print outputs the retries summary for the number of calls.
+func (r *RetryResults) Print(out io.Writer, calls int64) {
+	_, _ = fmt.Fprintf(out, "Retries: %d attempts for %d calls (%d retries), %d retried successes, %d final failures\n",
+		r.Attempts, calls, r.Attempts-calls, r.RetriedSuccesses, r.FinalFailures)
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Declarative echo server routes: per path and method behaviors.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"fortio.org/dflag"
+	"fortio.org/log"
+)
+
+// EchoRoutes is the JSON list of EchoRoute, e.g.
+// [{"path": "/api/users/**", "methods": ["GET"], "status": "503:5", "delay": "10ms:90,200ms:10"}].
+// Dynamic flag: invalid updates are rejected and the previous routes are kept, so it can be
+// hot reloaded from a file in the -config-dir.
+var EchoRoutes = dflag.New("",
+	"JSON list of echo server routes: path pattern and methods to status, delay, size, close, gzip, headers and body").
+	WithValidator(func(s string) error {
+		_, err := ParseEchoRoutes(s)
+		return err
+	}).
+	WithSyncNotifier(func(_, s string) {
+		routes, _ := ParseEchoRoutes(s) // already validated
+		echoRoutes.Store(routes)
+		log.Infof("Echo server routes updated: %d routes", len(routes))
+	})
+
+var echoRoutes atomic.Value // []*EchoRoute
+
+// EchoParam is an echo query argument value, which can be written as a JSON string or,
+// for convenience, number or boolean (e.g. "status": 503 or "close": true).
+type EchoParam string
+
+// UnmarshalJSON accepts strings, numbers and booleans.
+func (p *EchoParam) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*p = EchoParam(s)
+		return nil
+	}
+	if len(b) == 0 || b[0] == '[' || b[0] == '{' || bytes.Equal(b, []byte("null")) {
+		return fmt.Errorf("invalid echo parameter %s, should be a string, number or boolean", b)
+	}
+	*p = EchoParam(b)
+	return nil
+}
+
+// EchoRoute is the echo server behavior for the requests matching its Path and Methods.
+// The parameters have the same syntax (including probabilities) as the corresponding echo query
+// arguments, which, when present in the request, override them.
+type EchoRoute struct {
+	// Path pattern: exact path, glob (e.g. /api/*/users, see path.Match) or prefix when ending with "**".
+	Path string `json:"path"`
+	// Methods the route applies to, all of them if empty.
+	Methods []string  `json:"methods,omitempty"`
+	Status  EchoParam `json:"status,omitempty"`
+	Delay   EchoParam `json:"delay,omitempty"`
+	Size    EchoParam `json:"size,omitempty"`
+	Close   EchoParam `json:"close,omitempty"`
+	Gzip    EchoParam `json:"gzip,omitempty"`
+	// Headers to add to the response, as "Key: Value".
+	Headers []string `json:"headers,omitempty"`
+	// Fixed response body, replied instead of echoing the request's (size takes precedence).
+	Body string `json:"body,omitempty"`
+	// Query arguments equivalent of the above.
+	params url.Values
+}
+
+// ParseEchoRoutes parses and validates the JSON routes, nil for the empty string.
+func ParseEchoRoutes(s string) ([]*EchoRoute, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var routes []*EchoRoute
+	if err := json.Unmarshal([]byte(s), &routes); err != nil {
+		return nil, fmt.Errorf("invalid echo routes json: %w", err)
+	}
+	for i, rt := range routes {
+		if rt == nil || !strings.HasPrefix(rt.Path, "/") {
+			return nil, fmt.Errorf("echo route #%d: path should start with /", i)
+		}
+		if _, err := path.Match(strings.TrimSuffix(rt.Path, "**"), ""); err != nil {
+			return nil, fmt.Errorf("echo route #%d: invalid path pattern %q: %w", i, rt.Path, err)
+		}
+		for j, m := range rt.Methods {
+			rt.Methods[j] = strings.ToUpper(m)
+		}
+		rt.params = make(url.Values)
+		for _, kv := range []struct {
+			key   string
+			value EchoParam
+		}{{"status", rt.Status}, {"delay", rt.Delay}, {"size", rt.Size}, {"close", rt.Close}, {"gzip", rt.Gzip}} {
+			if kv.value != "" {
+				rt.params.Set(kv.key, string(kv.value))
+			}
+		}
+		for _, h := range rt.Headers {
+			if !strings.Contains(h, ":") {
+				return nil, fmt.Errorf("echo route #%d: invalid header %q, expecting Key: Value", i, h)
+			}
+			rt.params.Add("header", h)
+		}
+	}
+	return routes, nil
+}
+
+// Matches returns true if the route applies to the method and path.
+func (rt *EchoRoute) Matches(method, urlPath string) bool {
+	if len(rt.Methods) > 0 && !containsString(rt.Methods, method) {
+		return false
+	}
+	if strings.HasSuffix(rt.Path, "**") {
+		return strings.HasPrefix(urlPath, strings.TrimSuffix(rt.Path, "**"))
+	}
+	matched, _ := path.Match(rt.Path, urlPath) // pattern validated in ParseEchoRoutes
+	return matched
+}
+
+// matchingEchoRoute returns the first of the current EchoRoutes matching the request, nil if none does.
+func matchingEchoRoute(r *http.Request) *EchoRoute {
+	routes, _ := echoRoutes.Load().([]*EchoRoute)
+	for _, rt := range routes {
+		if rt.Matches(r.Method, r.URL.Path) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// apply returns a copy of the request with the route's parameters added to its query
+// arguments, unless already present.
+func (rt *EchoRoute) apply(r *http.Request) *http.Request {
+	q := r.URL.Query()
+	for k, v := range rt.params {
+		if _, found := q[k]; !found {
+			q[k] = v
+		}
+	}
+	nr := *r
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	nr.URL = &u
+	nr.Form = nil
+	log.LogVf("Echo route %q matched %s %s -> %q", rt.Path, r.Method, r.URL.Path, u.RawQuery)
+	return &nr
+}
@@ -88,9 +88,16 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 	if log.LogVerbose() {
 		log.LogRequest(r, "Echo") // will also print headers
 	}
+	if c := startCapture(w, r); c != nil {
+		defer c.done()
+		w, r = c.writer(), c.r
+	}
 	defaultParams := DefaultEchoServerParams.Get()
 	hasQuestionMark := strings.Contains(r.RequestURI, "?")
-	if !hasQuestionMark && len(defaultParams) > 0 {
+	route := matchingEchoRoute(r)
+	if route != nil {
+		r = route.apply(r)
+	} else if !hasQuestionMark && len(defaultParams) > 0 {
 		newQS := r.RequestURI + "?" + defaultParams
 		log.LogVf("Adding default base query string %q to %v trying %q", defaultParams, r.URL, newQS)
 		nr := *r
@@ -103,6 +110,13 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 			r = &nr
 		}
 	}
+	if rateLimited(w, r) {
+		return
+	}
+	if r.ProtoMajor == 1 && IsWebSocket(r) {
+		webSocketEcho(w, r)
+		return
+	}
 	reqNum := handleCommonArgs(w, r)
 	statusStr := QueryArg(r, "status")
 	var status int
@@ -111,6 +125,24 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		status = http.StatusOK
 	}
+	if fail, extraDelay := generateStateful(r); fail || extraDelay > 0 {
+		if extraDelay > 0 {
+			log.LogVf("Sleeping for additional %v", extraDelay)
+			time.Sleep(extraDelay)
+		}
+		if fail {
+			recordFault("stateful")
+			status = http.StatusServiceUnavailable
+			if failStatus := QueryArg(r, "fail-status"); failStatus != "" {
+				status = generateStatus(failStatus)
+			}
+		}
+	}
+	if status == http.StatusOK && IsSSE(r) {
+		sseEcho(w, r)
+		return
+	}
+	rawW := w // for faults, before the gzip wrapping
 	gzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && generateGzip(QueryArg(r, "gzip"))
 	if gzip {
 		gwz := NewGzipHTTPResponseWriter(w)
@@ -118,6 +150,8 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 		w = gwz
 	}
 	size := generateSize(QueryArg(r, "size")) // -1 means no size/payload mode
+	body := newEchoStream(w, r)
+	r.Body = slowReader(r)
 	var data []byte
 	var err error
 	// Also read the whole input if we're supposed to write something unrelated like size=100
@@ -131,9 +165,27 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if fault := generateFault(QueryArg(r, "fault")); fault != "" {
+		payload := data
+		if size >= 0 {
+			payload = fnet.Payload[:size]
+		} else if route != nil && route.Body != "" {
+			payload = []byte(route.Body)
+		}
+		injectFault(rawW, r, fault, status, payload)
+		return
+	}
 	if size >= 0 {
 		log.LogVf("Writing %d size with %d status", size, status)
-		writePayload(w, status, size)
+		writePayload(body, status, size)
+		return
+	}
+	if route != nil && route.Body != "" {
+		jrpc.SetHeaderIfMissing(w.Header(), "Content-Type", "text/plain; charset=UTF-8")
+		body.WriteHeader(status)
+		if _, err = io.WriteString(body, route.Body); err != nil {
+			log.Errf("Error writing route body %v to %v", err, r.RemoteAddr)
+		}
 		return
 	}
 	// echo back the Content-Type and Content-Length in the response
@@ -145,11 +197,15 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 	if reqNum > 0 {
 		jrpc.SetHeaderIfMissing(w.Header(), "x-fortio-id", strconv.FormatInt(reqNum, 10))
 	}
-	w.WriteHeader(status)
+	body.WriteHeader(status)
 	if h2Mode {
 		// h2 non gzip, non size case: stream the body back
+		var out io.Writer = FlushWriter{w}
+		if body.t != nil {
+			out = body // already flushing each chunk
+		}
 		var n int64
-		n, err = io.Copy(FlushWriter{w}, r.Body)
+		n, err = io.Copy(out, r.Body)
 		log.Debugf("H2 read/Copied %d", n)
 		if err != nil {
 			log.Errf("Error copying from body to output: %v", err)
@@ -157,7 +213,7 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		if _, err = w.Write(data); err != nil {
+		if _, err = body.Write(data); err != nil {
 			log.Errf("Error writing response %v to %v", err, r.RemoteAddr)
 		}
 	}
@@ -195,9 +251,9 @@ func handleCommonArgs(w http.ResponseWriter, r *http.Request) (rqNum int64) {
 	return // rqNum ie 0 most of the time
 }
 
-func writePayload(w http.ResponseWriter, status int, size int) {
-	jrpc.SetHeaderIfMissing(w.Header(), "Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(size))
+func writePayload(w *echoStream, status int, size int) {
+	jrpc.SetHeaderIfMissing(w.w.Header(), "Content-Type", "application/octet-stream")
+	w.w.Header().Set("Content-Length", strconv.Itoa(size))
 	w.WriteHeader(status)
 	n, err := w.Write(fnet.Payload[:size])
 	if err != nil || n != size {
@@ -239,7 +295,8 @@ func HTTPServerWithHandler(name string, port string, hdlr http.Handler) net.Addr
 	s := &http.Server{
 		ReadHeaderTimeout: ServerIdleTimeout.Get(),
 		IdleTimeout:       ServerIdleTimeout.Get(),
-		Handler:           h2c.NewHandler(hdlr, h2s),
+		Handler:           h2c.NewHandler(metricsHandler(name, hdlr), h2s),
+		ConnState:         connStateMetrics(name),
 	}
 	listener, addr := fnet.Listen(name, port)
 	if listener == nil {
@@ -264,11 +321,15 @@ func HTTPSServer(name string, port string, to *TLSOptions) (*http.ServeMux, net.
 	if err != nil {
 		return nil, nil
 	}
+	tlsStats := NewTLSStats(0, 0.0001)
+	tlsStats.instrumentServer(tlsConfig)
+	serverTLSStats.Store(addr.String(), tlsStats)
 	s := &http.Server{
 		ReadHeaderTimeout: ServerIdleTimeout.Get(),
 		IdleTimeout:       ServerIdleTimeout.Get(),
-		Handler:           m,
+		Handler:           metricsHandler(name, m),
 		TLSConfig:         tlsConfig,
+		ConnState:         connStateMetrics(name),
 	}
 	go func() {
 		err := s.ServeTLS(listener, to.Cert, to.Key)
@@ -439,6 +500,11 @@ func EchoDebugPath(debugPath string) string {
 	return strings.TrimSuffix(debugPath, "/") + "/echo/"
 }
 
+// TLSStatsPath returns the path of the TLS handshakes statistics (of https echo servers) for debugPath.
+func TLSStatsPath(debugPath string) string {
+	return strings.TrimSuffix(debugPath, "/") + "/tls"
+}
+
 // Serve starts a debug / echo http server on the given port.
 // Returns the mux and addr where the listening socket is bound.
 // The .Port can be retrieved from it when requesting the 0 port as
@@ -464,6 +530,11 @@ func ServeTLS(port, debugPath string, to *TLSOptions) (*http.ServeMux, net.Addr)
 	if debugPath != "" {
 		mux.Handle(debugPath, Gzip(http.HandlerFunc(DebugHandler)))
 		mux.HandleFunc(EchoDebugPath(debugPath), EchoHandler) // Fix #524
+		mux.HandleFunc(CapturePath(debugPath), CaptureHandler)
+		mux.HandleFunc(StatePath(debugPath), StateHandler)
+		if to.Cert != "" && to.Key != "" {
+			mux.HandleFunc(TLSStatsPath(debugPath), TLSStatsHandler(addr))
+		}
 	}
 	mux.HandleFunc("/", EchoHandler)
 	return mux, addr
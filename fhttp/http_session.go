@@ -0,0 +1,193 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Sessions: cookie jar and optional login request done by each client.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// LoginRequest is an optional request each client (ie each thread of a run) makes once,
+// before its other requests, to start a session: the cookies it receives are sent with
+// the following requests and a token can be extracted from its json response.
+type LoginRequest struct {
+	// Login url, relative urls (starting with /) are relative to the main url.
+	URL string
+	// Defaults to POST when there is a Payload, GET otherwise.
+	Method  string `json:",omitempty"`
+	Payload string `json:",omitempty"`
+	// Defaults to application/json for a json Payload, application/x-www-form-urlencoded otherwise.
+	ContentType string `json:",omitempty"`
+	// Optional dot separated path (e.g. "data.token") of a token in the json response.
+	TokenPath string `json:",omitempty"`
+	// Header to send the token in, defaults to Authorization with the token as Bearer
+	// credentials. The token is sent as is in any other header.
+	TokenHeader string `json:",omitempty"`
+}
+
+// session returns the cookie jar for a new client (nil when not keeping cookies) and,
+// after doing the Login request if any, the header name and value for its token.
+func (h *HTTPOptions) session() (http.CookieJar, string, string, error) {
+	if h.jar != nil || (!h.Cookies && h.Login == nil) {
+		return h.jar, "", "", nil
+	}
+	jar, _ := cookiejar.New(nil) // can't fail without options
+	if h.Login == nil {
+		return jar, "", "", nil
+	}
+	l := h.Login
+	lo := *h
+	lo.initDone = false
+	lo.jar = jar
+	lo.Login = nil
+	lo.URL = l.URL
+	if strings.HasPrefix(l.URL, "/") {
+		base, err := url.Parse(h.URL)
+		ref, err2 := url.Parse(l.URL)
+		if err == nil && err2 == nil {
+			lo.URL = base.ResolveReference(ref).String()
+		}
+	}
+	lo.Payload = []byte(l.Payload)
+	lo.MethodOverride = strings.ToUpper(l.Method)
+	lo.ContentType = l.ContentType
+	if lo.ContentType == "" && len(lo.Payload) > 0 {
+		lo.ContentType = "application/x-www-form-urlencoded"
+		if json.Valid(lo.Payload) {
+			lo.ContentType = "application/json"
+		}
+	}
+	lo.DisableFastClient = true
+	lo.FollowRedirects = false // the cookies of redirect responses are kept too
+	lo.Validation, lo.Retry, lo.PayloadReader, lo.h2Groups = nil, nil, nil, nil
+	var body bytes.Buffer
+	lo.DataWriter = &body
+	client, err := NewStdClient(&lo)
+	if err != nil {
+		return nil, "", "", err
+	}
+	code, _, _ := client.StreamFetch(context.Background())
+	client.Close()
+	if code < http.StatusOK || code >= http.StatusBadRequest {
+		err = fmt.Errorf("login to %s failed with status %d", lo.URL, code)
+		log.S(log.Error, "Login failed", log.Str("url", lo.URL), log.Attr("code", code),
+			log.Attr("thread", h.ID), log.Attr("run", h.UniqueID))
+		return nil, "", "", err
+	}
+	log.LogVf("[%d] Logged in %s: %d", h.ID, lo.URL, code)
+	if l.TokenPath == "" {
+		return jar, "", "", nil
+	}
+	token, found := jsonLookup(body.Bytes(), l.TokenPath)
+	if !found {
+		err = fmt.Errorf("token %q not found in login response from %s", l.TokenPath, lo.URL)
+		log.S(log.Error, "Login token not found", log.Str("path", l.TokenPath), log.Str("url", lo.URL),
+			log.Attr("thread", h.ID), log.Attr("run", h.UniqueID))
+		return nil, "", "", err
+	}
+	if l.TokenHeader != "" {
+		return jar, l.TokenHeader, fmt.Sprint(token), nil
+	}
+	return jar, "Authorization", "Bearer " + fmt.Sprint(token), nil
+}
+
+// cookieHeader returns the Cookie header value for the cookies.
+func cookieHeader(cookies []*http.Cookie) string {
+	parts := make([]string, len(cookies))
+	for i, c := range cookies {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+var setCookiePrefix = []byte("set-cookie:")
+
+// updateCookies stores the Set-Cookie of the last response in the jar and
+// updates the Cookie header sent with the next requests.
+func (c *FastClient) updateCookies() {
+	var h http.Header
+	headers := c.buffer[:c.headerLen]
+	for len(headers) > 0 {
+		line := headers
+		if i := bytes.Index(headers, []byte("\r\n")); i >= 0 {
+			line, headers = headers[:i], headers[i+2:]
+		} else {
+			headers = nil
+		}
+		if len(line) > len(setCookiePrefix) && bytes.EqualFold(line[:len(setCookiePrefix)], setCookiePrefix) {
+			if h == nil {
+				h = make(http.Header)
+			}
+			h.Add("Set-Cookie", string(bytes.TrimSpace(line[len(setCookiePrefix):])))
+		}
+	}
+	if h == nil {
+		return
+	}
+	c.jar.SetCookies(c.jarURL, (&http.Response{Header: h}).Cookies())
+	c.cookie = cookieHeader(c.jar.Cookies(c.jarURL))
+	log.Debugf("[%d] Cookies now %q", c.id, c.cookie)
+}
+
+// withCookie returns the request with the current Cookie header added at the end of its headers.
+func (c *FastClient) withCookie(req []byte) []byte {
+	end := bytes.Index(req, []byte("\r\n\r\n"))
+	if end < 0 {
+		return req
+	}
+	end += 2
+	b := append(c.cookieBuffer[:0], req[:end]...)
+	b = append(b, "Cookie: "...)
+	b = append(b, c.cookie...)
+	b = append(b, '\r', '\n')
+	b = append(b, req[end:]...)
+	c.cookieBuffer = b
+	return b
+}
+
+// setRetry implements retrier.
+func (c *FastClient) setRetry(retry bool) {
+	c.retry = retry
+	if !retry {
+		c.rendered = false
+	}
+}
+
+// nextRequest returns the bytes of the next request to send (rendering the templates,
+// adding the cookies, if any).
+func (c *FastClient) nextRequest() []byte {
+	switch {
+	case c.headTemplate != nil:
+		if c.retry && c.rendered {
+			return c.reqBuffer
+		}
+		c.rendered = true
+		return c.renderRequest()
+	case c.cookie != "":
+		return c.withCookie(c.req)
+	default:
+		return c.req
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Echo server Server-Sent Events (SSE) stream of timestamped events.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/log"
+)
+
+// SSEContentType is the content type of Server-Sent Events streams.
+const SSEContentType = "text/event-stream"
+
+// DefaultSSERate is the default number of events per second of the echo server SSE streams.
+var DefaultSSERate = 1.
+
+// MinSSERate and MaxSSERate are the bounds of the event-rate (events per second), so the
+// interval between events is between 1ns and ~31 years.
+const (
+	MinSSERate = 1e-9
+	MaxSSERate = 1e9
+)
+
+// SSEEvent is the json data of the echo server events.
+type SSEEvent struct {
+	Seq int64 `json:"seq"`
+	// Unix time, in nanoseconds, when the event was sent.
+	TS  int64  `json:"ts"`
+	Pad string `json:"pad,omitempty"`
+}
+
+// IsSSE returns true if the request accepts Server-Sent Events, like browsers' EventSource do.
+func IsSSE(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), SSEContentType)
+}
+
+// sseEcho streams events to the client, at the event-rate= events per second (DefaultSSERate if not set),
+// until the client goes away or events= events were sent. size= adds padding to each event's data.
+// The event ids are the sequence numbers, resuming after the Last-Event-ID on reconnects.
+func sseEcho(w http.ResponseWriter, r *http.Request) {
+	rate := DefaultSSERate
+	if rateStr := QueryArg(r, "event-rate"); rateStr != "" {
+		v, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || math.IsNaN(v) || v < MinSSERate || v > MaxSSERate {
+			log.Warnf("Bad input event-rate=%q, expecting a number between %g and %g: %v", rateStr, MinSSERate, MaxSSERate, err)
+		} else {
+			rate = v
+		}
+	}
+	count := parseCount(QueryArg(r, "events"), "events")
+	size := QueryArg(r, "size")
+	var seq int64
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		seq, _ = strconv.ParseInt(last, 10, 64)
+	}
+	h := w.Header()
+	h.Set("Content-Type", SSEContentType)
+	h.Set("Cache-Control", "no-cache")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	Flush(w)
+	log.LogVf("SSE stream started for %s %v at %g events/s, from %d", r.RemoteAddr, r.URL, rate, seq)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for i := int64(0); count == 0 || i < count; i++ {
+		if i > 0 { // first event right away
+			select {
+			case <-r.Context().Done():
+				log.LogVf("SSE stream for %s ended by the client after %d events", r.RemoteAddr, i)
+				return
+			case <-ticker.C:
+			}
+		}
+		seq++
+		ev := SSEEvent{Seq: seq}
+		if sz := generateSize(size); sz > 0 {
+			ev.Pad = strings.Repeat("x", sz)
+		}
+		ev.TS = time.Now().UnixNano()
+		data, _ := json.Marshal(&ev)
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", seq, data); err != nil {
+			log.LogVf("SSE write error to %s: %v", r.RemoteAddr, err)
+			return
+		}
+		Flush(w)
+	}
+	log.LogVf("SSE stream for %s done after %d events", r.RemoteAddr, count)
+}
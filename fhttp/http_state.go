@@ -0,0 +1,184 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Echo server stateful failure scenarios: every Nth request, time windows, first N requests
+// and progressively degrading latency.
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/jrpc"
+	"fortio.org/log"
+)
+
+// echoState is the number of requests and the time of the first one, for a path (or client key).
+type echoState struct {
+	mu    sync.Mutex
+	start time.Time
+	count int64
+}
+
+// MaxEchoStates is the maximum number of distinct state keys (paths and clients), further
+// ones share a single state (as the state-key header comes from the clients).
+var MaxEchoStates = 1000
+
+var (
+	echoStatesMutex sync.Mutex
+	echoStates      = make(map[string]*echoState) // state key -> state
+	otherEchoState  = &echoState{}                // for the keys beyond MaxEchoStates
+)
+
+// ResetEchoState forgets the state of all the paths and clients, so the scenarios start over.
+func ResetEchoState() {
+	echoStatesMutex.Lock()
+	echoStates = make(map[string]*echoState)
+	otherEchoState = &echoState{}
+	echoStatesMutex.Unlock()
+}
+
+// getEchoState returns the state for key, creating it if needed.
+func getEchoState(key string) *echoState {
+	echoStatesMutex.Lock()
+	defer echoStatesMutex.Unlock()
+	s := echoStates[key]
+	if s == nil {
+		if len(echoStates) >= MaxEchoStates {
+			return otherEchoState
+		}
+		s = &echoState{}
+		echoStates[key] = s
+	}
+	return s
+}
+
+// EchoStateInfo is the state of a path (or client key) as returned by the StateHandler.
+type EchoStateInfo struct {
+	Count int64
+	Start time.Time
+}
+
+// StatePath returns the path of the stateful scenarios state endpoint for debugPath.
+func StatePath(debugPath string) string {
+	return strings.TrimSuffix(debugPath, "/") + "/state"
+}
+
+// StateHandler replies with the json map of the stateful scenarios state keys (path,
+// followed by a newline and the state-key header value if any) to their number of requests
+// and time of the first one. reset=true forgets them so the scenarios start over.
+func StateHandler(w http.ResponseWriter, r *http.Request) {
+	log.LogRequest(r, "Echo state")
+	res := make(map[string]EchoStateInfo)
+	if QueryArg(r, "reset") == "true" {
+		ResetEchoState()
+		_ = jrpc.ReplyOk(w, &res)
+		return
+	}
+	echoStatesMutex.Lock()
+	for k, s := range echoStates {
+		s.mu.Lock()
+		res[k] = EchoStateInfo{Count: s.count, Start: s.start}
+		s.mu.Unlock()
+	}
+	echoStatesMutex.Unlock()
+	_ = jrpc.ReplyOk(w, &res)
+}
+
+// next counts a request and returns its number (starting at 1) and the elapsed time since the first one.
+func (s *echoState) next() (int64, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	if s.count == 1 {
+		s.start = time.Now()
+	}
+	return s.count, time.Since(s.start)
+}
+
+// stateKey returns the request's path, plus the value of the state-key= header if set,
+// so clients identified by that header each get their own state.
+func stateKey(r *http.Request) string {
+	key := r.URL.Path
+	if h := QueryArg(r, "state-key"); h != "" {
+		key += "\n" + r.Header.Get(h)
+	}
+	return key
+}
+
+// parseDurationPair parses "X:Y" durations, e.g. fail-window=5s:30s.
+func parseDurationPair(s, name string) (time.Duration, time.Duration, bool) {
+	a, b, found := strings.Cut(s, ":")
+	if !found {
+		log.Warnf("Bad input %s=%q, expecting 2 colon separated durations", name, s)
+		return 0, 0, false
+	}
+	x, err1 := time.ParseDuration(a)
+	y, err2 := time.ParseDuration(b)
+	if err1 != nil || err2 != nil || x < 0 || y <= 0 {
+		log.Warnf("Bad input %s=%q, expecting 2 colon separated positive durations: %v %v", name, s, err1, err2)
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+func parseCount(s, name string) int64 {
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		log.Warnf("Bad input %s=%q, expecting a positive number: %v", name, s, err)
+		return 0
+	}
+	return n
+}
+
+// generateStateful returns whether the request should fail and the additional delay, per the
+// stateful echo arguments (fail-every=N, fail-first=N, fail-window=X:Y, degrade=D:P)
+// and the state of its path (or client key).
+func generateStateful(r *http.Request) (fail bool, delay time.Duration) {
+	failEvery, failFirst := QueryArg(r, "fail-every"), QueryArg(r, "fail-first")
+	failWindow, degrade := QueryArg(r, "fail-window"), QueryArg(r, "degrade")
+	if failEvery == "" && failFirst == "" && failWindow == "" && degrade == "" {
+		return false, 0
+	}
+	key := stateKey(r)
+	n, elapsed := getEchoState(key).next()
+	if every := parseCount(failEvery, "fail-every"); every > 0 && n%every == 0 {
+		fail = true
+	}
+	if n <= parseCount(failFirst, "fail-first") {
+		fail = true
+	}
+	if failWindow != "" {
+		if x, y, ok := parseDurationPair(failWindow, "fail-window"); ok && elapsed%y < x {
+			fail = true
+		}
+	}
+	if degrade != "" {
+		if d, p, ok := parseDurationPair(degrade, "degrade"); ok {
+			delay = time.Duration(float64(d) * (float64(elapsed) / float64(p)))
+			if maxDelay := MaxDelay.Get(); delay > maxDelay || delay < 0 {
+				delay = maxDelay
+			}
+		}
+	}
+	log.LogVf("Stateful %q request #%d at %v: fail %v, extra delay %v", key, n, elapsed, fail, delay)
+	return fail, delay
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Per request templating of the URL, headers and payload.
+// Supported tokens:
+//
+//	{uuid}              random UUID v4
+//	{seq}               sequence number of the request (per thread/connection, starts at 0)
+//	{thread}            thread/goroutine id
+//	{runid}             run id
+//	{rand:min:max}      random integer in [min, max]
+//	{choice:a|b|c}      random pick from the | separated list
+//	{ts} or {ts:unit}   current unix time in ms (default) or s, us, ns unit
+//
+// Anything else between curly braces (e.g. json) is left as is.
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type templateKind int
+
+const (
+	tmplLiteral templateKind = iota
+	tmplUUID
+	tmplSeq
+	tmplThread
+	tmplRunID
+	tmplRand
+	tmplChoice
+	tmplTimestamp
+)
+
+var templateNames = map[string]templateKind{
+	"uuid":   tmplUUID,
+	"seq":    tmplSeq,
+	"thread": tmplThread,
+	"runid":  tmplRunID,
+	"rand":   tmplRand,
+	"choice": tmplChoice,
+	"ts":     tmplTimestamp,
+}
+
+type templatePart struct {
+	kind    templateKind
+	literal []byte
+	min     int64 // rand
+	n       int64 // rand: max-min+1
+	choices [][]byte
+	divisor int64 // ts: divides UnixNano
+}
+
+// requestTemplate is a parsed string with tokens substituted on each request.
+type requestTemplate struct {
+	parts []templatePart
+}
+
+// templateState is the per client (thread) state used when rendering templates.
+type templateState struct {
+	seq    int64
+	thread int
+	runID  int64
+}
+
+// hasTemplate returns true if the input contains at least one known token.
+// Only checks the names (errors in arguments are reported by parseTemplate).
+func hasTemplate(s string) bool {
+	for {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			return false
+		}
+		s = s[start+1:]
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return false
+		}
+		name, _, _ := strings.Cut(s[:end], ":")
+		if _, found := templateNames[name]; found {
+			return true
+		}
+	}
+}
+
+// parseTemplate parses the tokens in s. Returns nil (and no error) when s
+// has no token, so callers can keep their static (faster) path.
+func parseTemplate(s string) (*requestTemplate, error) {
+	if !hasTemplate(s) {
+		return nil, nil
+	}
+	t := &requestTemplate{}
+	literal := []byte{}
+	for {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+		token := s[start+1 : end]
+		name, args, hasArgs := strings.Cut(token, ":")
+		kind, found := templateNames[name]
+		if !found {
+			// not one of ours, keep the { and continue after it (could be json)
+			literal = append(literal, s[:start+1]...)
+			s = s[start+1:]
+			continue
+		}
+		literal = append(literal, s[:start]...)
+		if len(literal) > 0 {
+			t.parts = append(t.parts, templatePart{kind: tmplLiteral, literal: literal})
+			literal = []byte{}
+		}
+		part, err := parseTemplatePart(kind, args, hasArgs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template {%s}: %w", token, err)
+		}
+		t.parts = append(t.parts, part)
+		s = s[end+1:]
+	}
+	literal = append(literal, s...)
+	if len(literal) > 0 {
+		t.parts = append(t.parts, templatePart{kind: tmplLiteral, literal: literal})
+	}
+	return t, nil
+}
+
+func parseTemplatePart(kind templateKind, args string, hasArgs bool) (templatePart, error) {
+	p := templatePart{kind: kind}
+	switch kind { //nolint:exhaustive // literal isn't parsed here
+	case tmplRand:
+		minStr, maxStr, ok := strings.Cut(args, ":")
+		if !ok {
+			return p, fmt.Errorf("expecting rand:min:max")
+		}
+		min, err := strconv.ParseInt(minStr, 10, 64)
+		if err != nil {
+			return p, err
+		}
+		max, err := strconv.ParseInt(maxStr, 10, 64)
+		if err != nil {
+			return p, err
+		}
+		if max < min {
+			return p, fmt.Errorf("max %d < min %d", max, min)
+		}
+		p.min = min
+		p.n = max - min + 1
+	case tmplChoice:
+		if args == "" {
+			return p, fmt.Errorf("expecting choice:a|b|...")
+		}
+		for _, c := range strings.Split(args, "|") {
+			p.choices = append(p.choices, []byte(c))
+		}
+	case tmplTimestamp:
+		p.divisor = int64(time.Millisecond)
+		if hasArgs {
+			switch args {
+			case "s":
+				p.divisor = int64(time.Second)
+			case "ms":
+			case "us":
+				p.divisor = int64(time.Microsecond)
+			case "ns":
+				p.divisor = 1
+			default:
+				return p, fmt.Errorf("unknown ts unit %q, expecting s, ms, us or ns", args)
+			}
+		}
+	default:
+		if hasArgs {
+			return p, fmt.Errorf("unexpected arguments %q", args)
+		}
+	}
+	return p, nil
+}
+
+// Append renders the template and appends the result to dst.
+// It doesn't allocate beyond growing dst (except for {uuid}).
+func (t *requestTemplate) Append(dst []byte, ts *templateState) []byte {
+	for i := range t.parts {
+		p := &t.parts[i]
+		switch p.kind {
+		case tmplLiteral:
+			dst = append(dst, p.literal...)
+		case tmplUUID:
+			dst = append(dst, generateUUID()...)
+		case tmplSeq:
+			dst = strconv.AppendInt(dst, ts.seq, 10)
+		case tmplThread:
+			dst = strconv.AppendInt(dst, int64(ts.thread), 10)
+		case tmplRunID:
+			dst = strconv.AppendInt(dst, ts.runID, 10)
+		case tmplRand:
+			dst = strconv.AppendInt(dst, p.min+rand.Int63n(p.n), 10) //nolint:gosec // we want fast not crypto
+		case tmplChoice:
+			dst = append(dst, p.choices[rand.Intn(len(p.choices))]...) //nolint:gosec // we want fast not crypto
+		case tmplTimestamp:
+			dst = strconv.AppendInt(dst, time.Now().UnixNano()/p.divisor, 10)
+		}
+	}
+	return dst
+}
+
+// String renders the template as a string.
+func (t *requestTemplate) String(ts *templateState) string {
+	return string(t.Append(nil, ts))
+}
+
+// rawRequestURI returns the path and query part of the url string, without
+// escaping (unlike url.RequestURI()) so the tokens in it are left intact.
+func rawRequestURI(urlStr string) string {
+	if idx := strings.Index(urlStr, "://"); idx >= 0 {
+		urlStr = urlStr[idx+3:]
+	}
+	idx := strings.IndexAny(urlStr, "/?")
+	if idx < 0 {
+		return "/"
+	}
+	res := urlStr[idx:]
+	if idx = strings.IndexByte(res, '#'); idx >= 0 {
+		res = res[:idx]
+	}
+	if res[0] == '?' {
+		res = "/" + res
+	}
+	return res
+}
@@ -0,0 +1,179 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Echo server bandwidth throttled / slow drip responses and slow request reading.
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fortio.org/log"
+)
+
+// DefaultThrottleChunk is the chunk size in bytes for rate= and read-rate= when chunk= isn't set.
+const DefaultThrottleChunk = 1024
+
+// throttle paces the transfer of a body in chunks of chunk bytes, at rate bytes/sec on average
+// (unlimited if 0) and/or separated by delay.
+type throttle struct {
+	ctx   context.Context
+	rate  float64
+	chunk int
+	delay time.Duration
+	start time.Time
+	done  int64 // bytes transferred so far
+}
+
+// newThrottle returns the throttle for the rate, chunk and delay echo arguments,
+// nil if neither rate nor delay is set (or they don't parse).
+func newThrottle(ctx context.Context, rateStr, chunkStr, delayStr string) *throttle {
+	t := throttle{ctx: ctx, chunk: DefaultThrottleChunk}
+	var err error
+	if rateStr != "" {
+		if t.rate, err = strconv.ParseFloat(rateStr, 64); err != nil || t.rate < 0 {
+			log.Warnf("Bad input rate %q, should be a positive number of bytes/sec: %v", rateStr, err)
+			t.rate = 0
+		}
+	}
+	if delayStr != "" {
+		if t.delay, err = time.ParseDuration(delayStr); err != nil || t.delay < 0 {
+			log.Warnf("Bad input chunk-delay %q, should be a positive duration: %v", delayStr, err)
+			t.delay = 0
+		}
+	}
+	if t.rate == 0 && t.delay == 0 {
+		return nil
+	}
+	if chunkStr != "" {
+		if t.chunk, err = strconv.Atoi(chunkStr); err != nil || t.chunk <= 0 {
+			log.Warnf("Bad input chunk %q, should be a positive size in bytes: %v", chunkStr, err)
+			t.chunk = DefaultThrottleChunk
+		}
+	}
+	log.LogVf("Throttling to %g bytes/sec in chunks of %d bytes, %v apart", t.rate, t.chunk, t.delay)
+	return &t
+}
+
+// next waits until the next chunk can be transferred and returns its maximum size, or 0 if
+// the request was canceled in the meantime.
+func (t *throttle) next() int {
+	if t.start.IsZero() {
+		t.start = time.Now()
+		return t.chunk
+	}
+	d := t.delay
+	if t.rate > 0 {
+		// time at which the bytes done so far are at the target rate, if later than the delay
+		due := time.Until(t.start.Add(time.Duration(float64(t.done) / t.rate * float64(time.Second))))
+		if due > d {
+			d = due
+		}
+	}
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return 0
+		}
+	}
+	return t.chunk
+}
+
+// echoStream writes the response body of the echo server: throttled per the rate=, chunk= and
+// chunk-delay= arguments, flushing each chunk, and using chunked transfer encoding (instead of
+// setting the Content-Length) if chunked=.
+type echoStream struct {
+	w       http.ResponseWriter
+	t       *throttle
+	chunked bool
+}
+
+func newEchoStream(w http.ResponseWriter, r *http.Request) *echoStream {
+	return &echoStream{
+		w:       w,
+		t:       newThrottle(r.Context(), QueryArg(r, "rate"), QueryArg(r, "chunk"), QueryArg(r, "chunk-delay")),
+		chunked: generateSingleProbability(QueryArg(r, "chunked"), "chunked"),
+	}
+}
+
+// WriteHeader writes the headers, flushing them right away without a Content-Length in chunked mode.
+func (es *echoStream) WriteHeader(status int) {
+	if es.chunked {
+		es.w.Header().Del("Content-Length")
+	}
+	es.w.WriteHeader(status)
+	if es.chunked {
+		Flush(es.w)
+	}
+}
+
+func (es *echoStream) Write(p []byte) (int, error) {
+	if es.t == nil {
+		return es.w.Write(p)
+	}
+	n := 0
+	for len(p) > 0 {
+		c := es.t.next()
+		if c == 0 {
+			return n, es.t.ctx.Err()
+		}
+		if c > len(p) {
+			c = len(p)
+		}
+		m, err := es.w.Write(p[:c])
+		n += m
+		es.t.done += int64(m)
+		if err != nil {
+			return n, err
+		}
+		Flush(es.w)
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// throttledReader reads the request body at the read-rate= (bytes/sec), in chunk= bytes reads.
+type throttledReader struct {
+	io.ReadCloser
+	t *throttle
+}
+
+// slowReader returns the request body throttled per read-rate=, if set.
+func slowReader(r *http.Request) io.ReadCloser {
+	t := newThrottle(r.Context(), QueryArg(r, "read-rate"), QueryArg(r, "chunk"), "")
+	if t == nil {
+		return r.Body
+	}
+	return &throttledReader{r.Body, t}
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	c := tr.t.next()
+	if c == 0 {
+		return 0, tr.t.ctx.Err()
+	}
+	if c < len(p) {
+		p = p[:c]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	tr.t.done += int64(n)
+	return n, err
+}
@@ -0,0 +1,333 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// TLS handshake options (versions, ciphers, curves, sni, alpn, resumption) and statistics.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/jrpc"
+	"fortio.org/fortio/stats"
+	"fortio.org/log"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// ParseTLSVersion returns the tls version for "1.0" to "1.3" (optionally prefixed by "tls"),
+// 0 (ie the default) for the empty string.
+func ParseTLSVersion(s string) (uint16, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "tls")
+	if s == "" {
+		return 0, nil
+	}
+	if v, found := tlsVersions[s]; found {
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid tls version %q, should be one of 1.0, 1.1, 1.2 or 1.3", s)
+}
+
+// TLSVersionName returns the short name ("1.0" to "1.3") of the tls version.
+func TLSVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// parseCipherSuites returns the ids of the named cipher suites (as in tls.CipherSuiteName),
+// including the insecure ones.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[s.Name] = s.ID
+	}
+	res := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, found := known[strings.ToUpper(strings.TrimSpace(n))]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %q", n)
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
+
+// parseCurves returns the ids of the named curves (X25519, P256, P384 or P521).
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	res := make([]tls.CurveID, 0, len(names))
+	for _, n := range names {
+		n = strings.TrimPrefix(strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(n)), "-", ""), "CURVE")
+		id, found := tlsCurves[n]
+		if !found {
+			return nil, fmt.Errorf("unknown curve %q, should be one of X25519, P256, P384 or P521", n)
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
+
+// applyHandshakeOptions sets the versions, ciphers, curves, sni, alpn and session resumption options on cfg.
+func (to *TLSOptions) applyHandshakeOptions(cfg *tls.Config) error {
+	minVersion, err := ParseTLSVersion(to.MinVersion)
+	if err != nil {
+		return err
+	}
+	if minVersion != 0 {
+		cfg.MinVersion = minVersion
+	}
+	if cfg.MaxVersion, err = ParseTLSVersion(to.MaxVersion); err != nil {
+		return err
+	}
+	if cfg.MaxVersion != 0 && cfg.MaxVersion < cfg.MinVersion {
+		return fmt.Errorf("tls max version %s is lower than min version %s",
+			TLSVersionName(cfg.MaxVersion), TLSVersionName(cfg.MinVersion))
+	}
+	if cfg.CipherSuites, err = parseCipherSuites(to.CipherSuites); err != nil {
+		return err
+	}
+	if cfg.CurvePreferences, err = parseCurves(to.Curves); err != nil {
+		return err
+	}
+	cfg.ServerName = to.ServerName
+	cfg.NextProtos = to.ALPN
+	switch strings.ToLower(to.Resumption) {
+	case "":
+	case "on", "true":
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	case "off", "false":
+		cfg.SessionTicketsDisabled = true
+	default:
+		return fmt.Errorf("invalid tls resumption %q, should be on or off", to.Resumption)
+	}
+	return nil
+}
+
+// TLSStats accumulates the handshakes statistics of TLS clients or servers.
+type TLSStats struct {
+	mu         sync.Mutex
+	handshakes *stats.Histogram
+	versions   map[string]int64
+	ciphers    map[string]int64
+	resumed    int64
+}
+
+// TLSResults are the exported TLSStats.
+type TLSResults struct {
+	// Handshake duration histogram, its Count is the number of handshakes.
+	HandshakeTime *stats.HistogramData
+	// Negotiated versions and cipher suites counts.
+	Versions     map[string]int64
+	CipherSuites map[string]int64
+	// Number of resumed sessions and the ratio of resumed handshakes.
+	Resumed        int64
+	ResumptionRate float64
+}
+
+// NewTLSStats returns empty handshakes statistics with the given histogram offset and resolution.
+func NewTLSStats(offset, resolution float64) *TLSStats {
+	return &TLSStats{
+		handshakes: stats.NewHistogram(offset, resolution),
+		versions:   make(map[string]int64),
+		ciphers:    make(map[string]int64),
+	}
+}
+
+func (s *TLSStats) record(d time.Duration, cs *tls.ConnectionState) {
+	s.mu.Lock()
+	s.handshakes.Record(d.Seconds())
+	s.versions[TLSVersionName(cs.Version)]++
+	s.ciphers[tls.CipherSuiteName(cs.CipherSuite)]++
+	if cs.DidResume {
+		s.resumed++
+	}
+	s.mu.Unlock()
+}
+
+// Transfer merges the src stats into s and resets src. Ok to call with a nil src.
+func (s *TLSStats) Transfer(src *TLSStats) {
+	if src == nil {
+		return
+	}
+	src.mu.Lock()
+	s.mu.Lock()
+	s.handshakes.Transfer(src.handshakes)
+	for k, v := range src.versions {
+		s.versions[k] += v
+	}
+	for k, v := range src.ciphers {
+		s.ciphers[k] += v
+	}
+	s.resumed += src.resumed
+	src.versions = make(map[string]int64)
+	src.ciphers = make(map[string]int64)
+	src.resumed = 0
+	s.mu.Unlock()
+	src.mu.Unlock()
+}
+
+// Export returns the results, with the handshake time percentiles.
+func (s *TLSStats) Export(percentiles []float64) *TLSResults {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &TLSResults{
+		HandshakeTime: s.handshakes.Export().CalcPercentiles(percentiles),
+		Versions:      make(map[string]int64, len(s.versions)),
+		CipherSuites:  make(map[string]int64, len(s.ciphers)),
+		Resumed:       s.resumed,
+	}
+	for k, v := range s.versions {
+		res.Versions[k] = v
+	}
+	for k, v := range s.ciphers {
+		res.CipherSuites[k] = v
+	}
+	if res.HandshakeTime.Count > 0 {
+		res.ResumptionRate = float64(s.resumed) / float64(res.HandshakeTime.Count)
+	}
+	return res
+}
+
+// Print outputs the handshakes, resumption, versions and cipher suites counts.
+func (r *TLSResults) Print(out io.Writer) {
+	total := float64(r.HandshakeTime.Count)
+	_, _ = fmt.Fprintf(out, "TLS handshakes: %d, resumed %d (%.1f %%)\n", r.HandshakeTime.Count, r.Resumed, 100.*r.ResumptionRate)
+	printCounts(out, "TLS version", r.Versions, total)
+	printCounts(out, "TLS cipher", r.CipherSuites, total)
+}
+
+func printCounts(out io.Writer, what string, counts map[string]int64, total float64) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(out, "%s %s : %d (%.1f %%)\n", what, k, counts[k], 100.*float64(counts[k])/total)
+	}
+}
+
+// clientTrace returns the httptrace hooks recording the std client's handshakes in s.
+func (s *TLSStats) clientTrace() *httptrace.ClientTrace {
+	var start time.Time
+	return &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			start = time.Now()
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err == nil {
+				s.record(time.Since(start), &cs)
+			}
+		},
+	}
+}
+
+// tlsStatsGetter is implemented by both clients.
+type tlsStatsGetter interface {
+	// handshakeStats returns the TLS handshakes stats, nil when not using https.
+	handshakeStats() *TLSStats
+}
+
+func (c *FastClient) handshakeStats() *TLSStats {
+	return c.tlsStats
+}
+
+func (c *Client) handshakeStats() *TLSStats {
+	return c.tlsStats
+}
+
+// instrumentServer makes the server side cfg record each handshake (timed from the
+// ClientHello) in s.
+func (s *TLSStats) instrumentServer(cfg *tls.Config) {
+	// Same as http.Server.ServeTLS does on its own copy, which we don't get to see.
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	} else if !containsString(cfg.NextProtos, "http/1.1") {
+		cfg.NextProtos = append(cfg.NextProtos, "http/1.1")
+	}
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		start := time.Now()
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			s.record(time.Since(start), &cs)
+			return nil
+		}
+		return c, nil
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var serverTLSStats sync.Map // listening address string -> *TLSStats
+
+// ServerTLSStats returns the handshakes stats of the TLS server listening on addr
+// (started by HTTPSServer), nil if there is none.
+func ServerTLSStats(addr net.Addr, percentiles []float64) *TLSResults {
+	s, found := serverTLSStats.Load(addr.String())
+	if !found {
+		return nil
+	}
+	return s.(*TLSStats).Export(percentiles)
+}
+
+// TLSStatsHandler returns the handler replying with the json ServerTLSStats of addr.
+func TLSStatsHandler(addr net.Addr) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.LogRequest(r, "TLS stats")
+		res := ServerTLSStats(addr, []float64{50, 75, 90, 99, 99.9})
+		if res == nil {
+			_ = jrpc.ReplyError(w, "not a TLS server", nil)
+			return
+		}
+		_ = jrpc.ReplyOk(w, res)
+	}
+}
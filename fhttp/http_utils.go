@@ -21,6 +21,7 @@ import (
 	"encoding/base64"
 	"html/template"
 	"io"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
@@ -45,6 +46,19 @@ type TLSOptions struct {
 	Cert             string // `Path` to the certificate file to be used
 	Key              string // `Path` to the key file used
 	UnixDomainSocket string // `Path`` of unix domain socket to use instead of host:port
+
+	// Min and max TLS versions ("1.0" to "1.3"), min defaults to 1.2.
+	MinVersion string `json:",omitempty"`
+	MaxVersion string `json:",omitempty"`
+	// Cipher suite names (for TLS 1.2 and below) and curve preferences (e.g. X25519, P256).
+	CipherSuites []string `json:",omitempty"`
+	Curves       []string `json:",omitempty"`
+	// SNI server name override for clients (instead of the host, or the -H Host header).
+	ServerName string `json:",omitempty"`
+	// ALPN protocols to offer (clients) or accept (servers), replacing the default ones.
+	ALPN []string `json:",omitempty"`
+	// TLS session resumption: "on" or "off", empty for the default (off for clients, on for servers).
+	Resumption string `json:",omitempty"`
 }
 
 // TLSConfig creates a tls.Config based on input TLSOptions.
@@ -80,6 +94,10 @@ func (to *TLSOptions) TLSConfig() (*tls.Config, error) {
 		res.ClientAuth = tls.RequireAndVerifyClientCert
 		res.ClientCAs = res.RootCAs
 	}
+	if err := to.applyHandshakeOptions(res); err != nil {
+		log.Errf("Invalid TLS options: %v", err)
+		return nil, err
+	}
 	return res, nil
 }
 
@@ -379,6 +397,7 @@ var MaxDelay = dflag.New(1500*time.Millisecond,
 
 // generateDelay from string, format: delay="100ms" for 100% 100ms delay
 // delay="10ms:20,20ms:10,1s:0.5" for 20% 10ms, 10% 20ms, 0.5% 1s and 69.5% 0
+// or one of the delayDistributions, e.g. delay="lognormal:50ms:0.5".
 // TODO: very similar with generateStatus - refactor?
 func generateDelay(delay string) time.Duration {
 	lst := strings.Split(delay, ",")
@@ -386,6 +405,11 @@ func generateDelay(delay string) time.Duration {
 	if len(delay) == 0 {
 		return -1
 	}
+	if name, params, found := strings.Cut(delay, ":"); found {
+		if dist, isDist := delayDistributions[strings.ToLower(name)]; isDist {
+			return dist.generate(delay, params)
+		}
+	}
 	// Simple non probabilistic status case:
 	if len(lst) == 1 && !strings.ContainsRune(delay, ':') {
 		d, err := time.ParseDuration(delay)
@@ -445,6 +469,79 @@ func generateDelay(delay string) time.Duration {
 	return 0
 }
 
+// delayDistribution is a parametric delay distribution: its parameters are durations ('d' in units)
+// or unitless numbers ('n'), all positive, valid, if set, checks them further and gen returns
+// a delay in seconds.
+type delayDistribution struct {
+	units string
+	valid func(p []float64) bool
+	gen   func(p []float64) float64
+}
+
+// delayDistributions are the parametric delay= distributions, with colon separated parameters.
+var delayDistributions = map[string]delayDistribution{
+	// normal:mean:stddev e.g. normal:100ms:20ms
+	"normal": {"dd", nil, func(p []float64) float64 { return p[0] + p[1]*rand.NormFloat64() }},
+	// lognormal:median:sigma e.g. lognormal:50ms:0.5 (the larger sigma the longer the tail)
+	"lognormal": {"dn", nil, func(p []float64) float64 { return p[0] * math.Exp(p[1]*rand.NormFloat64()) }},
+	// exponential:mean e.g. exponential:20ms
+	"exponential": {"d", nil, func(p []float64) float64 { return p[0] * rand.ExpFloat64() }},
+	// pareto:minimum:alpha e.g. pareto:10ms:1.5 (long tail, the smaller alpha the longer)
+	"pareto": {
+		"dn", func(p []float64) bool { return p[1] > 0 },
+		func(p []float64) float64 { return p[0] / math.Pow(1-rand.Float64(), 1/p[1]) },
+	},
+	// uniform:min:max e.g. uniform:10ms:200ms
+	"uniform": {
+		"dd", func(p []float64) bool { return p[1] >= p[0] },
+		func(p []float64) float64 { return p[0] + (p[1]-p[0])*rand.Float64() },
+	},
+}
+
+// generate parses the params of the delay distribution and returns a random delay capped by
+// MaxDelay, or -1 if the params are invalid.
+func (dd delayDistribution) generate(delay, params string) time.Duration {
+	lst := strings.Split(params, ":")
+	if len(lst) != len(dd.units) {
+		log.Warnf("Expecting %d parameters for delay distribution %v", len(dd.units), delay)
+		return -1
+	}
+	p := make([]float64, len(lst))
+	for i, v := range lst {
+		var err error
+		if dd.units[i] == 'd' {
+			var d time.Duration
+			d, err = time.ParseDuration(v)
+			p[i] = d.Seconds()
+		} else {
+			p[i], err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil || p[i] < 0 || math.IsNaN(p[i]) || math.IsInf(p[i], 0) {
+			log.Warnf("Bad input delay distribution parameter %q in %v: %v", v, delay, err)
+			return -1
+		}
+	}
+	if dd.valid != nil && !dd.valid(p) {
+		log.Warnf("Invalid delay distribution parameters %v", delay)
+		return -1
+	}
+	seconds := dd.gen(p)
+	if math.IsNaN(seconds) {
+		log.Warnf("Invalid delay distribution %v result", delay)
+		return -1
+	}
+	maxDelay := MaxDelay.Get()
+	switch {
+	case seconds <= 0:
+		return 0
+	case seconds >= maxDelay.Seconds(): // also covers +Inf
+		return maxDelay
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	log.Debugf("Delay distribution %v -> %v", delay, d)
+	return d
+}
+
 // generateSingleProbability takes a string value and a name and returns a boolean.
 // false if the value is missing or "false".
 // true if the value is "true" or doesn't parse as a floating point number.
@@ -0,0 +1,268 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Validation failure reasons, keys of HTTPRunnerResults.ValidationErrors.
+const (
+	ValidationStatus   = "status"
+	ValidationBody     = "body"
+	ValidationRegex    = "regex"
+	ValidationJSON     = "json"
+	ValidationSize     = "size"
+	ValidationChecksum = "checksum"
+	ValidationHeader   = "header"
+)
+
+// ResponseValidation are the optional checks done on each response of a run.
+// Responses failing any of them are counted as errors. Note that for the fast
+// client, only what fits in the buffer (-httpbufferkb) can be checked.
+type ResponseValidation struct {
+	// Accepted status codes, when empty the usual 2xx (and 418) are.
+	Status []int `json:",omitempty"`
+	// The body must contain this string.
+	BodyContains string `json:",omitempty"`
+	// The body must match this regular expression.
+	BodyRegex string `json:",omitempty"`
+	// Dot separated path in the json body (e.g. "data.items.0.id") that must exist and,
+	// if JSONValue is set, be equal to it (the value in json form or as a raw string).
+	JSONPath  string `json:",omitempty"`
+	JSONValue string `json:",omitempty"`
+	// Exact body size, when > 0.
+	Size int64 `json:",omitempty"`
+	// Hex encoded sha256 of the body.
+	Checksum string `json:",omitempty"`
+	// Required response headers, either "Name" or "Name: value".
+	Headers []string `json:",omitempty"`
+	regex   *regexp.Regexp
+	json    interface{} // parsed JSONValue
+	isJSON  bool        // whether JSONValue is valid json
+	headers [][2]string
+	sum     []byte
+}
+
+// responseData is implemented by both clients to give access to the last response.
+type responseData interface {
+	// responseHeader returns the value of the named header in the last response.
+	responseHeader(name string) (string, bool)
+	// responseBody returns the body of the last response (only valid until the next call).
+	responseBody() []byte
+}
+
+// Init validates and compiles the checks.
+func (v *ResponseValidation) Init() error {
+	var err error
+	if v.BodyRegex != "" {
+		if v.regex, err = regexp.Compile(v.BodyRegex); err != nil {
+			return fmt.Errorf("invalid body regex %q: %w", v.BodyRegex, err)
+		}
+	}
+	if v.JSONValue != "" {
+		if v.JSONPath == "" {
+			return fmt.Errorf("json value %q without json path", v.JSONValue)
+		}
+		var j interface{}
+		if json.Unmarshal([]byte(v.JSONValue), &j) == nil {
+			v.json = j
+			v.isJSON = true
+		}
+	}
+	if v.Checksum != "" {
+		if v.sum, err = hex.DecodeString(v.Checksum); err != nil || len(v.sum) != sha256.Size {
+			return fmt.Errorf("invalid sha256 checksum %q", v.Checksum)
+		}
+	}
+	v.headers = nil
+	for _, h := range v.Headers {
+		name, value, _ := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("invalid expected header %q", h)
+		}
+		v.headers = append(v.headers, [2]string{name, strings.TrimSpace(value)})
+	}
+	return nil
+}
+
+// statusOK returns whether code is one of the accepted Status, or codeIsOK()
+// when there are none (or v is nil).
+func (v *ResponseValidation) statusOK(code int) bool {
+	if v == nil || len(v.Status) == 0 {
+		return codeIsOK(code)
+	}
+	for _, s := range v.Status {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+// needsBody is true when the checks need the response body.
+func (v *ResponseValidation) needsBody() bool {
+	return v.BodyContains != "" || v.regex != nil || v.JSONPath != "" || v.Size > 0 || v.sum != nil
+}
+
+// check returns the reason (one of the Validation* constants) for the first failed
+// check, or "" when the response is valid.
+func (v *ResponseValidation) check(code int, r responseData) string {
+	if !v.statusOK(code) {
+		return ValidationStatus
+	}
+	for _, h := range v.headers {
+		value, found := r.responseHeader(h[0])
+		if !found || (h[1] != "" && value != h[1]) {
+			return ValidationHeader
+		}
+	}
+	if !v.needsBody() {
+		return ""
+	}
+	body := r.responseBody()
+	if v.Size > 0 && int64(len(body)) != v.Size {
+		return ValidationSize
+	}
+	if v.BodyContains != "" && !bytes.Contains(body, []byte(v.BodyContains)) {
+		return ValidationBody
+	}
+	if v.regex != nil && !v.regex.Match(body) {
+		return ValidationRegex
+	}
+	if v.JSONPath != "" && !v.checkJSON(body) {
+		return ValidationJSON
+	}
+	if v.sum != nil {
+		sum := sha256.Sum256(body)
+		if !bytes.Equal(sum[:], v.sum) {
+			return ValidationChecksum
+		}
+	}
+	return ""
+}
+
+// jsonLookup returns the value at the dot separated path (e.g. "data.items.0.id") in the json body.
+func jsonLookup(body []byte, path string) (interface{}, bool) {
+	var j interface{}
+	if err := json.Unmarshal(body, &j); err != nil {
+		return nil, false
+	}
+	for _, p := range strings.Split(path, ".") {
+		switch node := j.(type) {
+		case map[string]interface{}:
+			var found bool
+			if j, found = node[p]; !found {
+				return nil, false
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(p)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, false
+			}
+			j = node[idx]
+		default:
+			return nil, false
+		}
+	}
+	return j, true
+}
+
+func (v *ResponseValidation) checkJSON(body []byte) bool {
+	j, found := jsonLookup(body, v.JSONPath)
+	if !found {
+		return false
+	}
+	if v.JSONValue == "" {
+		return true
+	}
+	if s, isString := j.(string); isString && s == v.JSONValue {
+		return true
+	}
+	if !v.isJSON {
+		return false
+	}
+	// compare the json forms (map keys are sorted by Marshal)
+	a, _ := json.Marshal(j)
+	b, _ := json.Marshal(v.json)
+	return bytes.Equal(a, b)
+}
+
+// dechunk returns the data of a chunked encoded body.
+func dechunk(data []byte) []byte {
+	res := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		start, size := ParseChunkSize(data)
+		if size <= 0 || start+size > int64(len(data)) {
+			break
+		}
+		res = append(res, data[start:start+size]...)
+		data = data[start+size:]
+		if len(data) >= 2 {
+			data = data[2:] // CRLF
+		}
+	}
+	return res
+}
+
+func (c *FastClient) responseHeader(name string) (string, bool) {
+	headers := c.buffer[:c.headerLen]
+	found, offset := FoldFind(headers, []byte("\r\n"+name+":"))
+	if !found {
+		return "", false
+	}
+	value := headers[offset+len(name)+3:]
+	if end := bytes.Index(value, []byte("\r\n")); end >= 0 {
+		value = value[:end]
+	}
+	return strings.TrimSpace(string(value)), true
+}
+
+func (c *FastClient) responseBody() []byte {
+	if c.decoder != nil && c.decoder.decoded != nil {
+		return c.decoder.decoded
+	}
+	return c.rawBody()
+}
+
+// rawBody returns the (possibly compressed) body as received, dechunked.
+func (c *FastClient) rawBody() []byte {
+	body := c.buffer[c.headerLen:c.size]
+	if found, _ := FoldFind(c.buffer[:c.headerLen], chunkedHeader); found {
+		return dechunk(body)
+	}
+	return body
+}
+
+func (c *Client) responseHeader(name string) (string, bool) {
+	values, found := c.lastHeader[http.CanonicalHeaderKey(name)]
+	if !found || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+func (c *Client) responseBody() []byte {
+	return c.lastBody.Bytes()
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Echo server WebSocket support: each message is echoed back, optionally delayed or
+// replaced by a payload of a given size.
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/fnet"
+	"fortio.org/log"
+	"golang.org/x/net/websocket"
+)
+
+// WSMessage is a WebSocket message and its type (websocket.TextFrame or websocket.BinaryFrame).
+type WSMessage struct {
+	Data        []byte
+	PayloadType byte
+}
+
+// WSMessageCodec sends and receives WSMessage, keeping the text or binary type of the messages.
+var WSMessageCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		m, ok := v.(*WSMessage)
+		if !ok {
+			return nil, 0, websocket.ErrNotSupported
+		}
+		return m.Data, m.PayloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		m, ok := v.(*WSMessage)
+		if !ok {
+			return websocket.ErrNotSupported
+		}
+		m.Data = data
+		m.PayloadType = payloadType
+		return nil
+	},
+}
+
+// IsWebSocket returns true if the request is a WebSocket upgrade (handshake) request.
+func IsWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// webSocketEcho upgrades the request to a WebSocket and echoes each received message.
+// The delay= and size= echo arguments apply to each message and header= ones to the handshake response.
+func webSocketEcho(w http.ResponseWriter, r *http.Request) {
+	delay := QueryArg(r, "delay")
+	size := QueryArg(r, "size")
+	headers := make(http.Header)
+	for _, hdr := range r.Form["header"] {
+		if k, v, found := strings.Cut(hdr, ":"); found {
+			headers.Add(k, v)
+		}
+	}
+	s := websocket.Server{
+		Handshake: func(c *websocket.Config, _ *http.Request) error {
+			c.Header = headers
+			return nil // no Origin check
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			log.LogVf("WebSocket echo started for %s %v", r.RemoteAddr, r.URL)
+			count := 0
+			for {
+				var m WSMessage
+				err := WSMessageCodec.Receive(ws, &m)
+				if err != nil {
+					if !errors.Is(err, io.EOF) {
+						log.LogVf("WebSocket read error from %s: %v", r.RemoteAddr, err)
+					}
+					break
+				}
+				count++
+				if dur := generateDelay(delay); dur > 0 {
+					time.Sleep(dur)
+				}
+				if sz := generateSize(size); sz >= 0 {
+					m.Data = fnet.Payload[:sz]
+					m.PayloadType = websocket.BinaryFrame
+				}
+				if err = WSMessageCodec.Send(ws, &m); err != nil {
+					log.LogVf("WebSocket write error to %s: %v", r.RemoteAddr, err)
+					break
+				}
+			}
+			log.LogVf("WebSocket echo done for %s after %d messages", r.RemoteAddr, count)
+		},
+	}
+	s.ServeHTTP(w, r)
+}
@@ -0,0 +1,277 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Curl mode write-out (-w): timings and details of a single fetch.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/log"
+)
+
+// FetchInfo are the details of a single (curl mode) fetch, filled by either client when
+// set in the HTTPOptions. The times are, like curl's, from Start to the end of each phase.
+type FetchInfo struct {
+	// Set by the caller before creating the client.
+	Start time.Time
+	URL   string
+	Code  int
+	// Response protocol, e.g. HTTP/1.1 or HTTP/2.0.
+	Proto      string
+	RemoteAddr string
+	// TLS version, cipher suite and ALPN negotiated protocol, for https.
+	TLSVersion string
+	TLSCipher  string
+	ALPN       string
+	// Response headers (including the status line) and body sizes, as received.
+	HeaderSize int64
+	BodySize   int64
+	// DNS resolution, tcp connection, TLS handshake, first response byte and total times.
+	NameLookup time.Duration
+	Connect    time.Duration
+	AppConnect time.Duration
+	FirstByte  time.Duration
+	Total      time.Duration
+}
+
+// The FetchInfo methods below are ok to call on nil, so the clients don't have to check.
+
+func (fi *FetchInfo) markNameLookup() {
+	if fi != nil {
+		fi.NameLookup = time.Since(fi.Start)
+	}
+}
+
+// markConnected sets the connection time, unless already set by markConnect (before the TLS handshake).
+func (fi *FetchInfo) markConnected(conn net.Conn) {
+	if fi == nil || conn == nil {
+		return
+	}
+	if fi.Connect == 0 {
+		fi.Connect = time.Since(fi.Start)
+	}
+	fi.RemoteAddr = conn.RemoteAddr().String()
+}
+
+func (fi *FetchInfo) markConnect() {
+	if fi != nil {
+		fi.Connect = time.Since(fi.Start)
+	}
+}
+
+func (fi *FetchInfo) markTLSDone(cs *tls.ConnectionState) {
+	if fi == nil {
+		return
+	}
+	fi.AppConnect = time.Since(fi.Start)
+	fi.TLSVersion = TLSVersionName(cs.Version)
+	fi.TLSCipher = tls.CipherSuiteName(cs.CipherSuite)
+	fi.ALPN = cs.NegotiatedProtocol
+}
+
+func (fi *FetchInfo) markFirstByte() {
+	if fi != nil && fi.FirstByte == 0 {
+		fi.FirstByte = time.Since(fi.Start)
+	}
+}
+
+// fastResponse records the fast client's response: buf holds the status line and headers
+// (headerLen bytes) then the body.
+func (fi *FetchInfo) fastResponse(code int, buf []byte, headerLen uint) {
+	if fi == nil {
+		return
+	}
+	if i := bytes.IndexByte(buf, ' '); i > 0 && headerLen > 0 {
+		fi.Proto = string(buf[:i])
+	}
+	fi.finish(code, int64(headerLen), int64(len(buf))-int64(headerLen))
+}
+
+// stdResponse records the std client's response protocol and headers size.
+func (fi *FetchInfo) stdResponse(resp *http.Response) {
+	if fi == nil {
+		return
+	}
+	fi.Proto = resp.Proto
+	var b bytes.Buffer
+	writeResponseHeaders(&b, resp)
+	fi.HeaderSize = int64(b.Len())
+}
+
+// writeResponseHeaders writes the status line and headers of the response, in http/1.x form.
+func writeResponseHeaders(w io.Writer, resp *http.Response) {
+	_, _ = fmt.Fprintf(w, "%s %s\r\n", resp.Proto, resp.Status)
+	_ = resp.Header.Write(w)
+	_, _ = io.WriteString(w, "\r\n")
+}
+
+func (fi *FetchInfo) finish(code int, headerSize, bodySize int64) {
+	if fi == nil {
+		return
+	}
+	fi.Code = code
+	if headerSize > 0 {
+		fi.HeaderSize = headerSize
+	}
+	if bodySize > 0 {
+		fi.BodySize = bodySize
+	}
+	fi.Total = time.Since(fi.Start)
+	if fi.FirstByte == 0 && code > 0 {
+		fi.FirstByte = fi.Total
+	}
+}
+
+// clientTrace returns the httptrace hooks filling fi for the std client.
+func (fi *FetchInfo) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			fi.markNameLookup()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				fi.markConnect()
+			}
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err == nil {
+				fi.markTLSDone(&cs)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			fi.markConnected(info.Conn)
+		},
+		GotFirstResponseByte: fi.markFirstByte,
+	}
+}
+
+// httpVersion returns the curl style http version, e.g. 1.1 or 2.
+func (fi *FetchInfo) httpVersion() string {
+	v := strings.TrimPrefix(fi.Proto, "HTTP/")
+	return strings.TrimSuffix(v, ".0")
+}
+
+// Variables returns the write-out variables, named like curl's (times in seconds).
+func (fi *FetchInfo) Variables() map[string]interface{} {
+	ip, port, _ := net.SplitHostPort(fi.RemoteAddr)
+	scheme := ""
+	if u, err := url.Parse(fi.URL); err == nil {
+		scheme = u.Scheme
+	}
+	speed := 0.
+	if fi.Total > 0 {
+		speed = float64(fi.BodySize) / fi.Total.Seconds()
+	}
+	pretransfer := fi.AppConnect
+	if pretransfer == 0 {
+		pretransfer = fi.Connect
+	}
+	return map[string]interface{}{
+		"url_effective":      fi.URL,
+		"scheme":             scheme,
+		"http_code":          fi.Code,
+		"response_code":      fi.Code,
+		"http_version":       fi.httpVersion(),
+		"remote_ip":          ip,
+		"remote_port":        port,
+		"tls_version":        fi.TLSVersion,
+		"tls_cipher":         fi.TLSCipher,
+		"alpn":               fi.ALPN,
+		"size_header":        fi.HeaderSize,
+		"size_download":      fi.BodySize,
+		"speed_download":     speed,
+		"time_namelookup":    fi.NameLookup.Seconds(),
+		"time_connect":       fi.Connect.Seconds(),
+		"time_appconnect":    fi.AppConnect.Seconds(),
+		"time_pretransfer":   pretransfer.Seconds(),
+		"time_starttransfer": fi.FirstByte.Seconds(),
+		"time_total":         fi.Total.Seconds(),
+	}
+}
+
+// JSON returns all the Variables as a json object.
+func (fi *FetchInfo) JSON() string {
+	b, _ := json.Marshal(fi.Variables()) // can't fail on these types
+	return string(b)
+}
+
+func formatVariable(v interface{}) string {
+	switch t := v.(type) {
+	case float64:
+		return strconv.FormatFloat(t, 'f', 6, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// WriteOut returns the curl style write-out format with the %{variable}s (or %{json} for all of
+// them) replaced by their values and the \n, \r, \t escapes interpreted.
+func (fi *FetchInfo) WriteOut(format string) string {
+	vars := fi.Variables()
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		switch {
+		case c == '\\' && i+1 < len(format):
+			i++
+			switch format[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(format[i])
+			}
+		case c == '%' && strings.HasPrefix(format[i+1:], "%"):
+			i++
+			b.WriteByte('%')
+		case c == '%' && strings.HasPrefix(format[i+1:], "{"):
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				b.WriteString(format[i:])
+				return b.String()
+			}
+			name := format[i+2 : i+end]
+			i += end
+			if name == "json" {
+				b.WriteString(fi.JSON())
+				continue
+			}
+			v, found := vars[name]
+			if !found {
+				log.Warnf("Unknown write-out variable %q", name)
+				continue
+			}
+			b.WriteString(formatVariable(v))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
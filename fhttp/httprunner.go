@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"fortio.org/fortio/periodic"
 	"fortio.org/fortio/stats"
@@ -48,28 +49,150 @@ type HTTPRunnerResults struct {
 	HeaderSizes *stats.HistogramData
 	Sockets     []int64
 	SocketCount int64
+	// Http/2 streams (ie requests) made by each fast client (thread) and total, when using h2.
+	Streams     []int64 `json:",omitempty"`
+	StreamCount int64   `json:",omitempty"`
 	// Connection Time stats
 	ConnectionStats *stats.HistogramData
+	// Proxy connection (and tunnel setup) time stats, when using a Proxy
+	ProxyConnectionStats *stats.HistogramData `json:",omitempty"`
+	// TLS handshakes stats, when using https
+	TLSStats *TLSResults `json:",omitempty"`
+	// Lifetime and number of requests of the connections (http/1.x for the fast client),
+	// and how many were closed by the server vs by the client (including at the end of the run).
+	ConnectionLifetime    *stats.HistogramData `json:",omitempty"`
+	RequestsPerConnection *stats.HistogramData `json:",omitempty"`
+	ServerCloses          int64
+	ClientCloses          int64
+	// Sizes with the bodies decoded, when the fast client Decompress'es (Sizes are then the wire sizes).
+	DecodedSizes *stats.HistogramData `json:",omitempty"`
+	decodedSizes *stats.Histogram
 	// http code to abort the run on (-1 for connection or other socket error)
 	AbortOn int
 	aborter *periodic.Aborter
+	// Per endpoint breakdown when replaying a request log.
+	Endpoints map[string]*EndpointResult `json:",omitempty"`
+	// Count of responses failing the Validation, by reason.
+	ValidationErrors map[string]int64 `json:",omitempty"`
+	validation       *ResponseValidation
+	// Retry accounting, when the Retry policy is enabled.
+	Retries *RetryResults `json:",omitempty"`
+	retry   *RetryPolicy
+	// replay state
+	replay            *replayer
+	replayClients     map[string]replayClient
+	replayNext        *replayEntry // set by replayPacer
+	pipelined         *FastClient  // set when pipelining, for RequestStart()
+	endpoints         map[string]*EndpointResult
+	endpointHistogram *stats.Histogram
 }
 
 // Run tests http request fetching. Main call being run at the target QPS.
 // To be set as the Function in RunnerOptions.
 func (httpstate *HTTPRunnerResults) Run(ctx context.Context, t periodic.ThreadID) (bool, string) {
 	log.Debugf("Calling in %d", t)
-	code, size, headerSize := httpstate.client.StreamFetch(ctx)
+	var entry *replayEntry
+	var start time.Time
+	client := httpstate.client
+	if httpstate.replay != nil {
+		entry = httpstate.replayNext
+		if entry == nil {
+			_, entry = httpstate.replay.claim()
+		}
+		httpstate.replayNext = nil
+		rc := httpstate.replayClients[entry.key]
+		rc.setReplayRequest(entry)
+		client = rc
+		start = time.Now()
+	}
+	rt, canRetry := client.(retrier)
+	if canRetry && httpstate.retry != nil {
+		rt.setRetry(false)
+	}
+	code, size, headerSize := client.StreamFetch(ctx)
+	attempts := 1
+	for httpstate.retry.ShouldRetry(attempts, code) && httpstate.retry.Wait(ctx, attempts) {
+		log.Debugf("Retrying after attempt %d got %d", attempts, code)
+		attempts++
+		if canRetry {
+			rt.setRetry(true) // same request, e.g. same {uuid} idempotency key
+		}
+		code, size, headerSize = client.StreamFetch(ctx)
+	}
 	log.Debugf("Got in %3d hsz %d sz %d - will abort on %d", code, headerSize, size, httpstate.AbortOn)
+	if entry != nil {
+		httpstate.recordEndpoint(entry, code, time.Since(start))
+	}
 	httpstate.RetCodes[code]++
 	httpstate.sizes.Record(float64(size))
 	httpstate.headerSizes.Record(float64(headerSize))
+	if httpstate.decodedSizes != nil {
+		if fc, ok := client.(decodedSizer); ok {
+			httpstate.decodedSizes.Record(float64(fc.decodedSize()))
+		}
+	}
 	if httpstate.AbortOn == code {
 		httpstate.aborter.Abort(false)
 		log.S(log.Info, "Aborted run because of http code",
 			log.Attr("run", httpstate.RunID), log.Attr("code", code), log.Attr("size", size))
 	}
-	return codeIsOK(code), strconv.Itoa(code)
+	ok, status := codeIsOK(code), strconv.Itoa(code)
+	if httpstate.validation != nil {
+		ok = true
+		if reason := httpstate.validation.check(code, client.(responseData)); reason != "" {
+			httpstate.ValidationErrors[reason]++
+			ok, status = false, status+" "+reason
+		}
+	}
+	if httpstate.Retries != nil {
+		httpstate.Retries.Record(attempts, ok)
+	}
+	return ok, status
+}
+
+// retrier is implemented by both clients.
+type retrier interface {
+	// setRetry sets whether the next requests are retries, sending again the last
+	// rendered request instead of rendering the templates anew.
+	setRetry(retry bool)
+}
+
+// decodedSizer is implemented by the fast client.
+type decodedSizer interface {
+	// decodedSize is the size of the last response with its body decoded.
+	decodedSize() int64
+}
+
+// RequestStart implements periodic.RequestStarter: in pipelining mode the latency
+// is measured from when the batch of requests was sent.
+func (httpstate *HTTPRunnerResults) RequestStart() time.Time {
+	if httpstate.pipelined == nil {
+		return time.Time{}
+	}
+	return httpstate.pipelined.RequestStart()
+}
+
+// MaxBatch implements periodic.Batcher: the last pipelined batch of a run
+// doesn't send more requests than the calls left.
+func (httpstate *HTTPRunnerResults) MaxBatch(n int64) {
+	if httpstate.pipelined != nil {
+		httpstate.pipelined.maxBatch = n
+	}
+}
+
+// Pending implements periodic.Batcher: the responses of the current pipelined
+// batch are read without pacing.
+func (httpstate *HTTPRunnerResults) Pending() bool {
+	return httpstate.pipelined != nil && httpstate.pipelined.pending > 0
+}
+
+// warmupFetch does the warmup call, reading all of the batch's responses when pipelining.
+func (httpstate *HTTPRunnerResults) warmupFetch(ctx context.Context) (int, int64, uint) {
+	code, dataLen, headerSize := httpstate.client.StreamFetch(ctx)
+	for fc := httpstate.pipelined; fc != nil && fc.pending > 0; {
+		fc.StreamFetch(ctx)
+	}
+	return code, dataLen, headerSize
 }
 
 // HTTPRunnerOptions includes the base RunnerOptions plus http specific
@@ -81,6 +204,14 @@ type HTTPRunnerOptions struct {
 	AllowInitialErrors bool   // whether initial errors don't cause an abort
 	// Which status code cause an abort of the run (default 0 = don't abort; reminder -1 is returned for socket errors)
 	AbortOn int
+	// Optional requests to replay, round robin, instead of the single URL (which is then the base
+	// for relative urls). See ReadReplayFile().
+	Replay []*ReplayRequest
+	// Whether to shuffle the order of the Replay requests.
+	ReplayShuffle bool
+	// When > 0, the Replay requests are sent at their original timing, sped up by that factor,
+	// instead of at the target QPS.
+	ReplaySpeed float64
 }
 
 // RunHTTPTest runs an http test and returns the aggregated stats.
@@ -100,6 +231,11 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	log.S(log.Info, "Starting http test", log.Attr("run", o.RunID), log.Str("url", o.URL),
 		log.Attr("threads", o.NumThreads), log.Str("qps", fmt.Sprintf("%.1f", o.QPS)), log.Str("warmup", warmupMode),
 		log.Str("conn-reuse", connReuseMsg))
+	timedReplay := len(o.Replay) > 0 && o.ReplaySpeed > 0
+	if timedReplay {
+		log.Infof("Replaying %d requests at %gx their original timing, ignoring qps", len(o.Replay), o.ReplaySpeed)
+		o.QPS = -1
+	}
 	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
 	if o.HTTPOptions.Resolution <= 0 {
 		// Set both connect histogram params when Resolution isn't set explicitly on the HTTP options
@@ -111,6 +247,10 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	numThreads := r.Options().NumThreads // can change during run for c > 2 n
 	o.HTTPOptions.UniqueID = o.RunnerOptions.RunID
 	o.HTTPOptions.Init(o.URL)
+	fastH2 := o.H2 && !o.DisableFastClient
+	if fastH2 && o.H2Streams > 1 {
+		o.HTTPOptions.h2Groups = newH2Groups(o.H2Streams)
+	}
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
 	total := HTTPRunnerResults{
 		HTTPOptions: o.HTTPOptions,
@@ -121,24 +261,65 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		AbortOn:     o.AbortOn,
 		aborter:     r.Options().Stop,
 	}
+	if o.Validation != nil {
+		if err := o.Validation.Init(); err != nil {
+			log.Errf("Invalid response validation: %v", err)
+			return nil, err
+		}
+		total.validation = o.Validation
+		total.ValidationErrors = make(map[string]int64)
+	}
+	if o.Decompress && !o.DisableFastClient {
+		total.decodedSizes = total.sizes.Clone()
+	}
+	if o.Retry.Enabled() {
+		if o.Pipeline > 1 {
+			log.Warnf("Retries are not supported with pipelining, ignoring the retry policy")
+		} else {
+			total.retry = o.Retry
+			total.Retries = &RetryResults{}
+		}
+	}
+	var replay *replayer
+	if len(o.Replay) > 0 {
+		var err error
+		if replay, err = newReplayer(o); err != nil {
+			return nil, err
+		}
+		total.endpoints = make(map[string]*EndpointResult)
+		total.endpointHistogram = stats.NewHistogram(r.Options().Offset.Seconds(), r.Options().Resolution)
+	}
 	httpstate := make([]HTTPRunnerResults, numThreads)
 	// First build all the clients sequentially. This ensures we do not have data races when
 	// constructing requests.
 	ctx := context.Background()
 	for i := 0; i < numThreads; i++ {
 		r.Options().Runners[i] = &httpstate[i]
+		if timedReplay {
+			r.Options().Runners[i] = replayPacer{&httpstate[i]}
+		}
 		// Temp mutate the option so each client gets a logging id
 		o.HTTPOptions.ID = i
 		// Create a client (and transport) and connect once for each 'thread'
 		var err error
-		httpstate[i].client, err = NewClient(&o.HTTPOptions)
+		if replay != nil {
+			httpstate[i].replay = replay
+			httpstate[i].endpoints = make(map[string]*EndpointResult)
+			httpstate[i].endpointHistogram = total.endpointHistogram
+			httpstate[i].replayClients, httpstate[i].client, err = replay.clients(i)
+		} else {
+			httpstate[i].client, err = NewClient(&o.HTTPOptions)
+		}
 		// nil check on interface doesn't work
 		if err != nil {
 			return nil, err
 		}
+		if fc, ok := httpstate[i].client.(*FastClient); ok && fc.pipeline > 1 {
+			httpstate[i].pipelined = fc
+		}
 		if o.SequentialWarmup && o.Exactly <= 0 {
-			code, dataLen, headerSize := httpstate[i].client.StreamFetch(ctx)
-			if !o.AllowInitialErrors && !codeIsOK(code) {
+			code, dataLen, headerSize := httpstate[i].warmupFetch(ctx)
+			if !o.AllowInitialErrors && !o.Validation.statusOK(code) {
 				return nil, fmt.Errorf("error %d for %s (%d body bytes)", code, o.URL, dataLen)
 			}
 			if i == 0 && log.LogVerbose() {
@@ -148,17 +329,28 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		// Setup the stats for each 'thread'
 		httpstate[i].sizes = total.sizes.Clone()
 		httpstate[i].headerSizes = total.headerSizes.Clone()
+		if total.decodedSizes != nil {
+			httpstate[i].decodedSizes = total.decodedSizes.Clone()
+		}
 		httpstate[i].RetCodes = make(map[int]int64)
 		httpstate[i].AbortOn = total.AbortOn
 		httpstate[i].aborter = total.aborter
+		if total.validation != nil {
+			httpstate[i].validation = total.validation
+			httpstate[i].ValidationErrors = make(map[string]int64)
+		}
+		if total.retry != nil {
+			httpstate[i].retry = total.retry
+			httpstate[i].Retries = &RetryResults{}
+		}
 	}
 	if o.Exactly <= 0 && !o.SequentialWarmup {
 		warmup := errgroup{}
 		for i := 0; i < numThreads; i++ {
 			i := i
 			warmup.Go(func() error {
-				code, dataLen, headerSize := httpstate[i].client.StreamFetch(ctx)
-				if !o.AllowInitialErrors && !codeIsOK(code) {
+				code, dataLen, headerSize := httpstate[i].warmupFetch(ctx)
+				if !o.AllowInitialErrors && !o.Validation.statusOK(code) {
 					return fmt.Errorf("error %d for %s (%d bytes)", code, o.URL, dataLen)
 				}
 				if i == 0 && log.LogVerbose() {
@@ -199,21 +391,40 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	}
 	// Connection stats, aggregated
 	connectionStats := stats.NewHistogram(o.HTTPOptions.Offset.Seconds(), o.HTTPOptions.Resolution)
+	proxyStats := stats.NewHistogram(o.HTTPOptions.Offset.Seconds(), o.HTTPOptions.Resolution)
+	tlsStats := NewTLSStats(o.HTTPOptions.Offset.Seconds(), o.HTTPOptions.Resolution)
+	connLifeStats := newConnectionStats(o.HTTPOptions.Resolution)
 	// Numthreads may have reduced:
 	numThreads = total.RunnerResults.NumThreads
 	// But we also must cleanup all the created clients.
 	keys := []int{}
 	fmt.Fprintf(out, "# Socket and IP used for each connection:\n")
 	for i := 0; i < numThreads; i++ {
-		// Get the report on the IP address each thread use to send traffic
-		occurrence, connStats := httpstate[i].client.GetIPAddress()
-		currentSocketUsed := connStats.Count
-		httpstate[i].client.Close()
-		// next 2 in 1 (long) line:
-		fmt.Fprintf(out, "[%d] %3d socket used, resolved to %s", i, currentSocketUsed, occurrence.AggregateAndToString(total.IPCountMap))
-		connStats.Counter.Print(out, ", connection timing")
+		var currentSocketUsed, currentStreams int64
+		for _, client := range httpstate[i].allClients() {
+			// Get the report on the IP address each thread use to send traffic
+			occurrence, connStats := client.GetIPAddress()
+			client.Close()
+			// next 2 in 1 (long) line:
+			fmt.Fprintf(out, "[%d] %3d socket used, resolved to %s", i, connStats.Count, occurrence.AggregateAndToString(total.IPCountMap))
+			connStats.Counter.Print(out, ", connection timing")
+			currentSocketUsed += connStats.Count
+			connectionStats.Transfer(connStats)
+			if ps := client.(proxyStatsGetter).proxyConnectStats(); ps != nil {
+				proxyStats.Transfer(ps)
+			}
+			tlsStats.Transfer(client.(tlsStatsGetter).handshakeStats())
+			connLifeStats.transfer(client.(connectionStatsGetter).closedConnectionStats())
+			if sc, ok := client.(streamCounter); ok {
+				currentStreams += sc.h2StreamCount()
+			}
+		}
 		total.SocketCount += currentSocketUsed
 		total.Sockets = append(total.Sockets, currentSocketUsed)
+		if fastH2 {
+			total.StreamCount += currentStreams
+			total.Streams = append(total.Streams, currentStreams)
+		}
 		// Q: is there some copying each time stats[i] is used?
 		for k := range httpstate[i].RetCodes {
 			if _, exists := total.RetCodes[k]; !exists {
@@ -223,7 +434,26 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		}
 		total.sizes.Transfer(httpstate[i].sizes)
 		total.headerSizes.Transfer(httpstate[i].headerSizes)
-		connectionStats.Transfer(connStats)
+		if total.decodedSizes != nil {
+			total.decodedSizes.Transfer(httpstate[i].decodedSizes)
+		}
+		for k, v := range httpstate[i].ValidationErrors {
+			total.ValidationErrors[k] += v
+		}
+		if total.Retries != nil {
+			total.Retries.Add(httpstate[i].Retries)
+		}
+		for k, ep := range httpstate[i].endpoints {
+			tep := total.endpoints[k]
+			if tep == nil {
+				tep = &EndpointResult{RetCodes: make(map[int]int64), durations: total.endpointHistogram.Clone()}
+				total.endpoints[k] = tep
+			}
+			for code, count := range ep.RetCodes {
+				tep.RetCodes[code] += count
+			}
+			tep.durations.Transfer(ep.durations)
+		}
 	}
 	total.ConnectionStats = connectionStats.Export().CalcPercentiles(o.Percentiles)
 	if log.Log(log.Info) {
@@ -231,6 +461,36 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	} else if log.Log(log.Warning) {
 		connectionStats.Counter.Print(out, "Connection time (s)")
 	}
+	if o.Proxy != "" {
+		total.ProxyConnectionStats = proxyStats.Export().CalcPercentiles(o.Percentiles)
+		if log.Log(log.Info) {
+			total.ProxyConnectionStats.Print(out, "Proxy connection time histogram (s)")
+		} else if log.Log(log.Warning) {
+			proxyStats.Counter.Print(out, "Proxy connection time (s)")
+		}
+	}
+	total.ConnectionLifetime = connLifeStats.lifetime.Export().CalcPercentiles(o.Percentiles)
+	total.RequestsPerConnection = connLifeStats.requests.Export().CalcPercentiles(o.Percentiles)
+	total.ServerCloses, total.ClientCloses = connLifeStats.serverCloses, connLifeStats.clientCloses
+	if total.ConnectionLifetime.Count > 0 {
+		if log.Log(log.Info) {
+			total.ConnectionLifetime.Print(out, "Connection lifetime histogram (s)")
+			total.RequestsPerConnection.Print(out, "Requests per connection histogram")
+		} else if log.Log(log.Warning) {
+			connLifeStats.lifetime.Counter.Print(out, "Connection lifetime (s)")
+			connLifeStats.requests.Counter.Print(out, "Requests per connection")
+		}
+		_, _ = fmt.Fprintf(out, "Connections closed by the server: %d, by the client: %d\n", total.ServerCloses, total.ClientCloses)
+	}
+	if o.https {
+		total.TLSStats = tlsStats.Export(o.Percentiles)
+		if log.Log(log.Info) {
+			total.TLSStats.HandshakeTime.Print(out, "TLS handshake time histogram (s)")
+		} else if log.Log(log.Warning) {
+			tlsStats.handshakes.Counter.Print(out, "TLS handshake time (s)")
+		}
+		total.TLSStats.Print(out)
+	}
 
 	// Sort the ip address form largest to smallest based on its usage count
 	ipList := make([]string, 0, len(total.IPCountMap))
@@ -246,7 +506,16 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	r.Options().ReleaseRunners()
 	sort.Ints(keys)
 	totalCount := float64(total.DurationHistogram.Count)
-	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect keepalive, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	if total.StreamCount > 0 {
+		perfect := r.Options().NumThreads
+		if o.H2Streams > 1 {
+			perfect = (perfect + o.H2Streams - 1) / o.H2Streams
+		}
+		_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect keepalive, would be %d), http/2 streams: %d\n",
+			total.SocketCount, perfect, total.StreamCount)
+	} else {
+		_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect keepalive, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	}
 	_, _ = fmt.Fprintf(out, "Uniform: %t, Jitter: %t, Catchup allowed: %t\n", total.Uniform, total.Jitter, !total.NoCatchUp)
 	_, _ = fmt.Fprintf(out, "IP addresses distribution:\n")
 	for _, v := range ipList {
@@ -255,14 +524,40 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	for _, k := range keys {
 		_, _ = fmt.Fprintf(out, "Code %3d : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
 	}
+	if len(total.ValidationErrors) > 0 {
+		reasons := make([]string, 0, len(total.ValidationErrors))
+		for k := range total.ValidationErrors {
+			reasons = append(reasons, k)
+		}
+		sort.Strings(reasons)
+		for _, k := range reasons {
+			v := total.ValidationErrors[k]
+			_, _ = fmt.Fprintf(out, "Validation failed on %s : %d (%.1f %%)\n", k, v, 100.*float64(v)/totalCount)
+		}
+	}
+	if total.Retries != nil {
+		total.Retries.Print(out, total.DurationHistogram.Count)
+	}
+	if replay != nil {
+		total.exportEndpoints(out, o.Percentiles)
+	}
 	total.HeaderSizes = total.headerSizes.Export()
 	total.Sizes = total.sizes.Export()
+	if total.decodedSizes != nil {
+		total.DecodedSizes = total.decodedSizes.Export()
+	}
 	if log.LogVerbose() {
 		total.HeaderSizes.Print(out, "Response Header Sizes Histogram")
 		total.Sizes.Print(out, "Response Body/Total Sizes Histogram")
+		if total.DecodedSizes != nil {
+			total.DecodedSizes.Print(out, "Response Decoded Body/Total Sizes Histogram")
+		}
 	} else if log.Log(log.Warning) {
 		total.headerSizes.Counter.Print(out, "Response Header Sizes")
 		total.sizes.Counter.Print(out, "Response Body/Total Sizes")
+		if total.decodedSizes != nil {
+			total.decodedSizes.Counter.Print(out, "Response Decoded Body/Total Sizes")
+		}
 	}
 	return &total, nil
 }
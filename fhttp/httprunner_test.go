@@ -21,13 +21,16 @@ import (
 	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httptrace"
 	"os"
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -669,3 +672,468 @@ func TestRunnerErrors(t *testing.T) {
 		t.Error("Expecting an error because of invalid url")
 	}
 }
+
+func TestReadReplay(t *testing.T) {
+	jsonl := `{"url":"/a"}
+{"method":"put","url":"/b","body":"xyz","headers":{"X-Foo":"bar"},"time":"2023-10-01T10:00:00.5Z"}
+`
+	reqs, err := ReadReplay(strings.NewReader(jsonl))
+	if err != nil {
+		t.Fatalf("Unexpected jsonl error: %v", err)
+	}
+	if len(reqs) != 2 || reqs[1].Method != "put" || reqs[1].Body != "xyz" || reqs[1].Headers["X-Foo"] != "bar" {
+		t.Errorf("Unexpected jsonl parse result %+v", reqs)
+	}
+	har := `{"log":{"version":"1.2","entries":[
+ {"startedDateTime":"2023-10-01T10:00:00.000Z","request":{"method":"GET","url":"http://localhost/x",
+   "headers":[{"name":"Accept","value":"*/*"}]}},
+ {"startedDateTime":"2023-10-01T10:00:01.000Z","request":{"method":"POST","url":"http://localhost/y",
+   "headers":[],"postData":{"mimeType":"text/plain","text":"hello"}}}]}}`
+	reqs, err = ReadReplay(strings.NewReader(har))
+	if err != nil {
+		t.Fatalf("Unexpected har error: %v", err)
+	}
+	if len(reqs) != 2 || reqs[0].Headers["Accept"] != "*/*" || reqs[1].Body != "hello" ||
+		reqs[1].Time.Sub(reqs[0].Time) != time.Second {
+		t.Errorf("Unexpected har parse result %+v %+v", reqs[0], reqs[1])
+	}
+	for _, bad := range []string{"", `{"method":"GET"}`, `{"url":"/a"} not json`, `{"log":{"version":"1.2","entries":[]}}`} {
+		if _, err = ReadReplay(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func testReplay(t *testing.T, stdClient bool) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	baseURL := fmt.Sprintf("http://localhost:%d/", addr.Port)
+	o := HTTPRunnerOptions{}
+	o.URL = baseURL
+	o.DisableFastClient = stdClient
+	o.Exactly = 30
+	o.NumThreads = 3
+	o.QPS = -1
+	o.Replay = []*ReplayRequest{
+		{URL: "/a?status=200"},
+		{Method: "PUT", URL: "b/c", Body: "xyz"},
+		{Name: "503s", URL: baseURL + "d?status=503"},
+	}
+	o.ReplayShuffle = true
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Replay error: %v", err)
+	}
+	if res.RetCodes[200] != 20 || res.RetCodes[503] != 10 {
+		t.Errorf("Unexpected codes %v", res.RetCodes)
+	}
+	if len(res.Endpoints) != 3 {
+		t.Fatalf("Expected 3 endpoints, got %+v", res.Endpoints)
+	}
+	for name, code := range map[string]int{"GET /a": 200, "PUT /b/c": 200, "503s": 503} {
+		ep := res.Endpoints[name]
+		if ep == nil {
+			t.Errorf("Missing endpoint %q in %v", name, res.Endpoints)
+			continue
+		}
+		if ep.RetCodes[code] != 10 || ep.DurationHistogram.Count != 10 {
+			t.Errorf("Unexpected %q endpoint result %v %d", name, ep.RetCodes, ep.DurationHistogram.Count)
+		}
+	}
+}
+
+func TestReplayFastClient(t *testing.T) {
+	testReplay(t, false)
+}
+
+func TestReplayStdClient(t *testing.T) {
+	testReplay(t, true)
+}
+
+func TestReplayTiming(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	o := HTTPRunnerOptions{}
+	o.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	o.Exactly = 4
+	o.NumThreads = 2
+	o.QPS = 1000 // ignored
+	now := time.Now()
+	o.Replay = []*ReplayRequest{
+		{URL: "/a", Time: now},
+		{URL: "/b", Time: now.Add(200 * time.Millisecond)},
+		{URL: "/c", Time: now.Add(400 * time.Millisecond)},
+		{URL: "/d", Time: now.Add(600 * time.Millisecond)},
+	}
+	o.ReplaySpeed = 2
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Replay error: %v", err)
+	}
+	if res.DurationHistogram.Count != 4 {
+		t.Errorf("Expected 4 calls, got %d", res.DurationHistogram.Count)
+	}
+	// 600ms at 2x speed: 300ms
+	if res.ActualDuration < 290*time.Millisecond || res.ActualDuration > 450*time.Millisecond {
+		t.Errorf("Unexpected replay duration %v", res.ActualDuration)
+	}
+	// sleeping isn't counted in the latency
+	if res.DurationHistogram.Max > 0.1 {
+		t.Errorf("Unexpected max latency %g", res.DurationHistogram.Max)
+	}
+}
+
+func TestReplayOutOfOrder(t *testing.T) {
+	o := HTTPRunnerOptions{}
+	o.URL = "http://localhost:8080/"
+	now := time.Now()
+	o.Replay = []*ReplayRequest{
+		{URL: "/c", Time: now.Add(400 * time.Millisecond)},
+		{URL: "/a", Time: now},
+		{URL: "/c2"}, // no time: same as the previous one
+		{URL: "/b", Time: now.Add(200 * time.Millisecond)},
+	}
+	rp, err := newReplayer(&o)
+	if err != nil {
+		t.Fatalf("Unexpected replay error: %v", err)
+	}
+	expected := []struct {
+		name   string
+		offset time.Duration
+	}{{"GET /a", 0}, {"GET /c2", 0}, {"GET /b", 200 * time.Millisecond}, {"GET /c", 400 * time.Millisecond}}
+	for i, e := range expected {
+		if rp.entries[i].name != e.name || rp.offsets[i] != e.offset {
+			t.Errorf("Entry %d: got %q at %v, expected %q at %v", i, rp.entries[i].name, rp.offsets[i], e.name, e.offset)
+		}
+	}
+}
+
+func testValidation(t *testing.T, stdClient bool) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	o := HTTPRunnerOptions{}
+	o.URL = fmt.Sprintf("http://localhost:%d/?status=200:25,404:25&header=X-Test:yes", addr.Port)
+	o.DisableFastClient = stdClient
+	o.Payload = []byte(`{"result": {"status": "ok"}}`)
+	o.Exactly = 100
+	o.NumThreads = 2
+	o.QPS = -1
+	o.Validation = &ResponseValidation{
+		Status:    []int{200, 503},
+		JSONPath:  "result.status",
+		JSONValue: "ok",
+		Headers:   []string{"X-Test: yes"},
+	}
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	errs := res.ValidationErrors[ValidationStatus]
+	if errs != res.RetCodes[404] || errs < 10 || errs > 45 {
+		t.Errorf("Unexpected status failures %v for codes %v", res.ValidationErrors, res.RetCodes)
+	}
+	if res.ErrorsDurationHistogram.Count != errs {
+		t.Errorf("Errors %d don't match validation failures %d", res.ErrorsDurationHistogram.Count, errs)
+	}
+	o.Validation = &ResponseValidation{JSONPath: "result.status", JSONValue: "ko"}
+	o.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	o.AllowInitialErrors = true
+	res, err = RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res.ValidationErrors[ValidationJSON] != 100 || res.RetCodes[200] != 100 {
+		t.Errorf("Expected all json failures, got %v for %v", res.ValidationErrors, res.RetCodes)
+	}
+	// Accepted non 2xx code: the whole response is read and checked, and the connections reused.
+	o.Validation = &ResponseValidation{
+		Status:    []int{404},
+		JSONPath:  "result.status",
+		JSONValue: "ok",
+		Headers:   []string{"X-Test: yes"},
+	}
+	o.URL = fmt.Sprintf("http://localhost:%d/?status=404&header=X-Test:yes", addr.Port)
+	o.AllowInitialErrors = false
+	res, err = RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(res.ValidationErrors) != 0 || res.RetCodes[404] != 100 {
+		t.Errorf("Expected all valid 404s, got %v for %v", res.ValidationErrors, res.RetCodes)
+	}
+	if res.SocketCount != 2 {
+		t.Errorf("Expected the 2 connections to be reused, got %d sockets", res.SocketCount)
+	}
+}
+
+func TestValidationFastClient(t *testing.T) {
+	testValidation(t, false)
+}
+
+func TestValidationStdClient(t *testing.T) {
+	testValidation(t, true)
+}
+
+func TestRunnerProxyStats(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(EchoHandler))
+	defer tlsServer.Close()
+	proxy := httptest.NewServer(&testProxy{})
+	defer proxy.Close()
+	for _, std := range []bool{false, true} {
+		for _, url := range []string{fmt.Sprintf("http://localhost:%d/", addr.Port), tlsServer.URL} {
+			o := HTTPRunnerOptions{}
+			o.URL = url
+			o.Proxy = proxy.URL
+			o.Insecure = true
+			o.DisableFastClient = std
+			o.NumThreads = 2
+			o.Exactly = 20
+			o.QPS = -1
+			res, err := RunHTTPTest(&o)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if res.RetCodes[http.StatusOK] != 20 {
+				t.Errorf("std %v %s: unexpected codes %v", std, url, res.RetCodes)
+			}
+			if res.ProxyConnectionStats == nil || res.ProxyConnectionStats.Count != 2 {
+				t.Errorf("std %v %s: unexpected proxy connection stats %+v", std, url, res.ProxyConnectionStats)
+			}
+		}
+	}
+	o := HTTPRunnerOptions{}
+	o.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	o.Exactly = 1
+	res, _ := RunHTTPTest(&o)
+	if res.ProxyConnectionStats != nil {
+		t.Errorf("Unexpected proxy connection stats without proxy %+v", res.ProxyConnectionStats)
+	}
+}
+
+func TestRunnerFastClientH2(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	for _, streams := range []int{0, 2, 4} {
+		o := HTTPRunnerOptions{}
+		o.URL = fmt.Sprintf("http://localhost:%d/?delay=5ms", addr.Port)
+		o.H2 = true
+		o.FastH2 = true
+		o.H2Streams = streams
+		o.NumThreads = 4
+		o.Exactly = 40
+		o.QPS = -1
+		res, err := RunHTTPTest(&o)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		expectedSockets := int64(4)
+		if streams > 1 {
+			expectedSockets = int64(4 / streams)
+		}
+		if res.RetCodes[http.StatusOK] != 40 || res.StreamCount != 40 || len(res.Streams) != 4 || res.SocketCount != expectedSockets {
+			t.Errorf("streams %d: unexpected codes %v, %d streams %v, %d sockets (expected %d)",
+				streams, res.RetCodes, res.StreamCount, res.Streams, res.SocketCount, expectedSockets)
+		}
+	}
+}
+
+func TestRunnerPipelining(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	o := HTTPRunnerOptions{}
+	o.URL = fmt.Sprintf("http://localhost:%d/?delay=20ms", addr.Port)
+	o.Pipeline = 4
+	o.NumThreads = 2
+	o.Exactly = 40
+	o.QPS = -1
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res.RetCodes[http.StatusOK] != 40 || res.SocketCount != 2 {
+		t.Errorf("Unexpected codes %v or sockets %d", res.RetCodes, res.SocketCount)
+	}
+	// The server handles the pipelined requests one at a time, so the last of each batch
+	// takes about 4 times the delay (measured from when the batch was sent).
+	if res.DurationHistogram.Max < 0.075 {
+		t.Errorf("Expected latency measured from the batch start, got max %g", res.DurationHistogram.Max)
+	}
+}
+
+func TestRunnerPipeliningQPS(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var count atomic.Int64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+	})
+	o := HTTPRunnerOptions{}
+	o.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	o.Pipeline = 4
+	o.NumThreads = 1
+	o.Exactly = 10 // not a multiple of the pipeline depth: the last batch is smaller
+	o.QPS = 10
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res.RetCodes[http.StatusOK] != 10 || count.Load() != 10 {
+		t.Errorf("Unexpected codes %v or server requests %d", res.RetCodes, count.Load())
+	}
+	// The 100ms qps pacing is between batches, not counted in the latency of the pipelined calls:
+	if res.DurationHistogram.Max > 0.080 {
+		t.Errorf("Pacing shouldn't be counted in pipelined latency, got max %g", res.DurationHistogram.Max)
+	}
+}
+
+func TestRunnerRetries(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var count atomic.Int64
+	var mu sync.Mutex
+	requests := map[string]int{} // distinct (templated) requests
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests[r.URL.String()+" "+r.Header.Get("X-Id")+" "+string(body)]++
+		mu.Unlock()
+		if count.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	tests := []struct {
+		std       bool
+		retries   int
+		calls     int64
+		attempts  int64
+		successes int64
+		failures  int64
+		ok        int64
+	}{
+		{false, 2, 10, 30, 10, 0, 10},
+		{true, 2, 10, 30, 10, 0, 10},
+		{false, 1, 4, 6, 0, 2, 2},
+	}
+	for _, tst := range tests {
+		count.Store(0)
+		requests = map[string]int{}
+		o := HTTPRunnerOptions{}
+		// retries send the same request again, not newly rendered templates
+		o.URL = fmt.Sprintf("http://localhost:%d/{seq}?r={rand:0:1000000}", addr.Port)
+		_ = o.AddAndValidateExtraHeader("X-Id: {uuid}")
+		o.Payload = []byte("body-{ts:ns}")
+		o.DisableFastClient = tst.std
+		o.NumThreads = 1
+		o.Exactly = tst.calls
+		o.QPS = -1
+		var err error
+		o.Retry, err = NewRetryPolicy(tst.retries, "503", time.Millisecond, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		res, err := RunHTTPTest(&o)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		r := res.Retries
+		if r == nil || r.Attempts != tst.attempts || r.RetriedSuccesses != tst.successes || r.FinalFailures != tst.failures {
+			t.Errorf("std %v retries %d: unexpected retry results %+v", tst.std, tst.retries, r)
+		}
+		if res.RetCodes[http.StatusOK] != tst.ok || res.RetCodes[http.StatusServiceUnavailable] != tst.calls-tst.ok {
+			t.Errorf("std %v retries %d: unexpected codes %v", tst.std, tst.retries, res.RetCodes)
+		}
+		if int64(len(requests)) != tst.calls {
+			t.Errorf("std %v retries %d: expected %d distinct requests, got %v", tst.std, tst.retries, tst.calls, requests)
+		}
+	}
+}
+
+func TestRunnerLogin(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var logins atomic.Int64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			logins.Add(1)
+		}
+		sessionHandler(w, r)
+	})
+	o := HTTPRunnerOptions{}
+	o.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	o.NumThreads = 3
+	o.Exactly = 30
+	o.QPS = -1
+	o.Login = &LoginRequest{URL: "/login", Payload: "password=p"}
+	o.Validation = &ResponseValidation{BodyContains: "session=abc"}
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if logins.Load() != 3 {
+		t.Errorf("Expected one login per thread, got %d", logins.Load())
+	}
+	if res.RetCodes[http.StatusOK] != 30 || len(res.ValidationErrors) != 0 {
+		t.Errorf("Unexpected codes %v or validation errors %v", res.RetCodes, res.ValidationErrors)
+	}
+}
+
+func TestRunnerDecompress(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	o := HTTPRunnerOptions{}
+	o.URL = fmt.Sprintf("http://localhost:%d/echo?size=4000&gzip=true", addr.Port)
+	o.Decompress = true
+	o.NumThreads = 2
+	o.Exactly = 10
+	o.QPS = -1
+	o.Validation = &ResponseValidation{Size: 4000}
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res.RetCodes[http.StatusOK] != 10 || len(res.ValidationErrors) != 0 {
+		t.Errorf("Unexpected codes %v or validation errors %v", res.RetCodes, res.ValidationErrors)
+	}
+	if res.DecodedSizes == nil || res.DecodedSizes.Count != 10 || res.DecodedSizes.Min < 4000 || res.DecodedSizes.Min == res.Sizes.Min {
+		t.Errorf("Unexpected decoded sizes %+v vs wire sizes %+v", res.DecodedSizes, res.Sizes)
+	}
+}
+
+func TestRunnerConnectionLifetime(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.Init(fmt.Sprintf("http://localhost:%d/echo", addr.Port))
+		opts.QPS = -1
+		opts.NumThreads = 1
+		opts.Exactly = 10
+		opts.DisableFastClient = std
+		if !std {
+			opts.ConnReuseRange = [2]int{4, 4}
+		}
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt, rpc := res.ConnectionLifetime, res.RequestsPerConnection
+		if res.ServerCloses != 0 || res.ClientCloses != res.SocketCount || lt.Count != res.SocketCount || rpc.Count != res.SocketCount {
+			t.Errorf("Unexpected (std %v) closes %d/%d for %d sockets, lifetimes %+v", std, res.ServerCloses, res.ClientCloses,
+				res.SocketCount, lt)
+		}
+		if int64(rpc.Sum) != res.DurationHistogram.Count || (!std && rpc.Max != 4) {
+			t.Errorf("Unexpected (std %v) requests per connection %+v for %d requests", std, rpc, res.DurationHistogram.Count)
+		}
+		// Server closing each connection after its response.
+		opts.URL += "?close=true"
+		opts.ConnReuseRange = [2]int{0, 0}
+		res, err = RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpc = res.RequestsPerConnection
+		if res.ServerCloses < res.SocketCount-1 || res.ClientCloses > 1 || rpc.Max != 1 || int64(rpc.Sum) != res.DurationHistogram.Count {
+			t.Errorf("Unexpected (std %v) closes %d/%d for %d sockets, requests per connection %+v", std, res.ServerCloses,
+				res.ClientCloses, res.SocketCount, rpc)
+		}
+	}
+}
@@ -17,10 +17,12 @@ package fhttp
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -225,3 +227,151 @@ func TestDefaultQueryParam(t *testing.T) {
 		t.Errorf("Got %d instead of 200 with bad default query", code)
 	}
 }
+
+func TestTLSOptionsErrors(t *testing.T) {
+	for _, to := range []TLSOptions{
+		{MinVersion: "1.4"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_FOO"}},
+		{Curves: []string{"P999"}},
+		{Resumption: "maybe"},
+	} {
+		if _, err := to.TLSConfig(); err == nil {
+			t.Errorf("Expected error for %+v", to)
+		}
+	}
+	to := TLSOptions{
+		MinVersion: "tls1.2", MaxVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		Curves: []string{"x25519", "P-256"}, ServerName: "foo.example", ALPN: []string{"http/1.1"}, Resumption: "on",
+	}
+	cfg, err := to.TLSConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS13 ||
+		len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+		len(cfg.CurvePreferences) != 2 || cfg.CurvePreferences[1] != tls.CurveP256 ||
+		cfg.ServerName != "foo.example" || cfg.NextProtos[0] != "http/1.1" || cfg.ClientSessionCache == nil {
+		t.Errorf("Unexpected config for %+v: %+v", to, cfg)
+	}
+}
+
+func TestTLSStats(t *testing.T) {
+	_, a := ServeTLS("0", "/debug", &TLSOptions{Cert: svrCrt, Key: svrKey})
+	if a == nil {
+		t.Fatalf("Failed to create server")
+	}
+	url := fmt.Sprintf("https://localhost:%d/debug", a.(*net.TCPAddr).Port)
+	for _, std := range []bool{false, true} {
+		o := HTTPRunnerOptions{}
+		o.URL = url
+		o.CACert = caCrt
+		o.MaxVersion = "1.2"
+		o.Resumption = "on"
+		o.DisableKeepAlive = true
+		o.DisableFastClient = std
+		o.NumThreads = 2
+		o.Exactly = 10
+		o.QPS = -1
+		res, err := RunHTTPTest(&o)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if res.RetCodes[http.StatusOK] != 10 {
+			t.Errorf("Unexpected codes %v", res.RetCodes)
+		}
+		ts := res.TLSStats
+		if ts == nil || ts.HandshakeTime.Count < 10 || ts.Versions["1.2"] != ts.HandshakeTime.Count {
+			t.Fatalf("Unexpected tls stats (std %v) %+v", std, ts)
+		}
+		// The first connection of each thread is a full handshake, the next ones resume.
+		if ts.Resumed < ts.HandshakeTime.Count-2 || ts.ResumptionRate <= 0.5 {
+			t.Errorf("Unexpected resumption (std %v) %d / %d", std, ts.Resumed, ts.HandshakeTime.Count)
+		}
+	}
+	// Without resumption (client default) and with tls 1.3 only.
+	o := HTTPRunnerOptions{}
+	o.URL = url
+	o.CACert = caCrt
+	o.MinVersion = "1.3"
+	o.DisableKeepAlive = true
+	o.NumThreads = 1
+	o.Exactly = 3
+	o.QPS = -1
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if ts := res.TLSStats; ts == nil || ts.Resumed != 0 || ts.Versions["1.3"] != 3 || ts.CipherSuites["TLS_AES_128_GCM_SHA256"] == 0 {
+		t.Errorf("Unexpected tls 1.3 stats %+v", ts)
+	}
+	// SNI override not matching the server certificate.
+	co := HTTPOptions{URL: url, TLSOptions: TLSOptions{CACert: caCrt, ServerName: "wrong.example"}}
+	client, _ := NewClient(&co)
+	if code, _, _ := client.Fetch(context.Background()); code != -1 {
+		t.Errorf("Got %d instead of expected error for wrong sni", code)
+	}
+	// Server side.
+	ss := ServerTLSStats(a, nil)
+	if ss == nil || ss.HandshakeTime.Count < 23 || ss.Resumed < 16 || ss.Versions["1.3"] < 3 {
+		t.Errorf("Unexpected server tls stats %+v", ss)
+	}
+	co = HTTPOptions{URL: url + "/tls", TLSOptions: TLSOptions{CACert: caCrt}}
+	client, _ = NewClient(&co)
+	code, data, _ := client.Fetch(context.Background())
+	if code != http.StatusOK || !strings.Contains(string(data), "\"ResumptionRate\":") {
+		t.Errorf("Unexpected tls stats endpoint reply %d: %s", code, data)
+	}
+	if ServerTLSStats(&net.TCPAddr{Port: 1}, nil) != nil {
+		t.Errorf("Expected no stats for non tls server")
+	}
+}
+
+// The std client composes its traces with ClientTrace's per request: no growing hook chain
+// nor data race (make test runs with -race).
+func TestStdClientTraces(t *testing.T) {
+	_, a := ServeTLS("0", "/debug", &TLSOptions{Cert: svrCrt, Key: svrKey})
+	if a == nil {
+		t.Fatalf("Failed to create server")
+	}
+	var numConn atomic.Int64
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			numConn.Add(1)
+		},
+	}
+	o := HTTPRunnerOptions{}
+	o.URL = fmt.Sprintf("https://localhost:%d/debug", a.(*net.TCPAddr).Port)
+	o.CACert = caCrt
+	o.DisableFastClient = true
+	o.ClientTrace = func(context.Context) *httptrace.ClientTrace { return trace }
+	o.NumThreads = 4
+	o.Exactly = 40
+	o.QPS = -1
+	res, err := RunHTTPTest(&o)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res.RetCodes[http.StatusOK] != 40 || numConn.Load() != 40 {
+		t.Errorf("Unexpected codes %v or traced requests %d", res.RetCodes, numConn.Load())
+	}
+	if ts := res.TLSStats; ts == nil || ts.HandshakeTime.Count != int64(res.SocketCount) {
+		t.Errorf("Expected one handshake per socket (%d), got %+v", res.SocketCount, ts)
+	}
+}
+
+func TestFetchInfoTLS(t *testing.T) {
+	_, a := ServeTLS("0", "", &TLSOptions{Cert: svrCrt, Key: svrKey})
+	url := fmt.Sprintf("https://localhost:%d/", a.(*net.TCPAddr).Port)
+	for _, std := range []bool{false, true} {
+		info := &FetchInfo{Start: time.Now(), URL: url}
+		o := HTTPOptions{URL: url, TLSOptions: TLSOptions{CACert: caCrt, MaxVersion: "1.2"}, DisableFastClient: std, FetchInfo: info}
+		client, _ := NewClient(&o)
+		code, _, _ := client.StreamFetch(context.Background())
+		client.Close()
+		if code != http.StatusOK || info.TLSVersion != "1.2" || info.TLSCipher == "" ||
+			info.AppConnect <= info.Connect || info.FirstByte < info.AppConnect {
+			t.Errorf("Unexpected code %d / info %+v (std %v)", code, info, std)
+		}
+	}
+}
@@ -25,6 +25,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"fortio.org/dflag"
@@ -756,3 +758,110 @@ func DebugSummary(buf []byte, max int) string {
 	// moved to jrpc package
 	return jrpc.DebugSummary(buf, max)
 }
+
+// SourceAddress is a set of local ips (and optional port range) outgoing connections
+// are bound to, round robin per connection. Useful to avoid ephemeral ports exhaustion
+// and to simulate many clients ips.
+type SourceAddress struct {
+	Spec    string
+	ips     []net.IP
+	minPort int // 0 when the port is chosen by the OS
+	maxPort int
+	next    atomic.Uint64
+}
+
+var (
+	sourceAddresses      = make(map[string]*SourceAddress)
+	sourceAddressesMutex sync.Mutex
+	// MaxSourceAddressRetries is how many next local addresses are tried when
+	// the chosen local port is already in use.
+	MaxSourceAddressRetries = 100
+)
+
+// GetSourceAddress returns the (shared, so round robin is across all the connections
+// of all the clients using the same spec) SourceAddress for the spec,
+// which is a comma separated list of local ips, optionally followed by :port or
+// :minport-maxport (use [] around ipv6 addresses in that case), for instance
+// "10.0.0.1,10.0.0.2:20000-30000". An empty spec returns nil (no binding).
+func GetSourceAddress(spec string) (*SourceAddress, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	sourceAddressesMutex.Lock()
+	defer sourceAddressesMutex.Unlock()
+	if s, found := sourceAddresses[spec]; found {
+		return s, nil
+	}
+	s, err := parseSourceAddress(spec)
+	if err != nil {
+		log.Errf("Invalid source address %q: %v", spec, err)
+		return nil, err
+	}
+	sourceAddresses[spec] = s
+	return s, nil
+}
+
+func parseSourceAddress(spec string) (*SourceAddress, error) {
+	s := &SourceAddress{Spec: spec}
+	ips := spec
+	last := strings.TrimSpace(spec[strings.LastIndex(spec, ",")+1:])
+	if idx := strings.LastIndex(spec, ":"); idx >= 0 && net.ParseIP(strings.Trim(last, "[]")) == nil {
+		ips = spec[:idx]
+		ports := strings.SplitN(spec[idx+1:], "-", 2)
+		var err error
+		if s.minPort, err = strconv.Atoi(ports[0]); err != nil {
+			return nil, fmt.Errorf("invalid port %q", ports[0])
+		}
+		s.maxPort = s.minPort
+		if len(ports) == 2 {
+			if s.maxPort, err = strconv.Atoi(ports[1]); err != nil {
+				return nil, fmt.Errorf("invalid port %q", ports[1])
+			}
+		}
+		if s.minPort <= 0 || s.maxPort > 65535 || s.maxPort < s.minPort {
+			return nil, fmt.Errorf("invalid port range %d-%d", s.minPort, s.maxPort)
+		}
+	}
+	for _, ipStr := range strings.Split(ips, ",") {
+		ip := net.ParseIP(strings.Trim(strings.TrimSpace(ipStr), "[]"))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", ipStr)
+		}
+		s.ips = append(s.ips, ip)
+	}
+	return s, nil
+}
+
+// LocalAddr returns the next local address for the network (tcp* or udp*).
+func (s *SourceAddress) LocalAddr(network string) net.Addr {
+	n := s.next.Add(1) - 1
+	ip := s.ips[n%uint64(len(s.ips))]
+	port := 0
+	if s.minPort > 0 {
+		port = s.minPort + int((n/uint64(len(s.ips)))%uint64(s.maxPort-s.minPort+1))
+	}
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// DialContext connects to address using (a copy of) the dialer bound to the next local
+// address, or the dialer as is if s is nil or for unix domain sockets. When a port range
+// is used, the next addresses are tried if the port is already in use.
+func (s *SourceAddress) DialContext(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	if s == nil || network == UnixDomainSocket {
+		return d.DialContext(ctx, network, address)
+	}
+	dd := *d
+	for i := 0; ; i++ {
+		dd.LocalAddr = s.LocalAddr(network)
+		conn, err := dd.DialContext(ctx, network, address)
+		if err == nil || s.minPort == 0 || !errors.Is(err, syscall.EADDRINUSE) || i >= MaxSourceAddressRetries {
+			if err != nil {
+				log.LogVf("Dial from %v to %s failed: %v", dd.LocalAddr, address, err)
+			}
+			return conn, err
+		}
+	}
+}
@@ -795,6 +795,84 @@ func TestResolveNoFilter(t *testing.T) {
 	}
 }
 
+func TestSourceAddress(t *testing.T) {
+	s, err := fnet.GetSourceAddress("")
+	if s != nil || err != nil {
+		t.Errorf("Expected nil,nil for empty spec, got %v, %v", s, err)
+	}
+	invalid := []string{"foo", "127.0.0.1:x", "127.0.0.1:10-x", "127.0.0.1:0", "127.0.0.1:20-10", "127.0.0.1:70000", "127.0.0.1,bar:1000"}
+	for _, bad := range invalid {
+		if _, err = fnet.GetSourceAddress(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+	tests := []struct {
+		spec     string
+		network  string
+		expected []string
+	}{
+		{"127.0.0.1", "tcp", []string{"127.0.0.1:0", "127.0.0.1:0"}},
+		{"::1", "tcp", []string{"[::1]:0"}},
+		{"[::1]:3000", "udp", []string{"[::1]:3000", "[::1]:3000"}},
+		{"10.0.0.1, 10.0.0.2:1000-1001", "tcp", []string{
+			"10.0.0.1:1000", "10.0.0.2:1000", "10.0.0.1:1001", "10.0.0.2:1001", "10.0.0.1:1000",
+		}},
+	}
+	for _, tst := range tests {
+		s, err = fnet.GetSourceAddress(tst.spec)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", tst.spec, err)
+		}
+		if s2, _ := fnet.GetSourceAddress(tst.spec); s2 != s {
+			t.Errorf("Expected same shared instance for %q", tst.spec)
+		}
+		for i, e := range tst.expected {
+			a := s.LocalAddr(tst.network)
+			if a.String() != e || a.Network() != tst.network {
+				t.Errorf("%q #%d: got %s %s, expected %s %s", tst.spec, i, a.Network(), a, tst.network, e)
+			}
+		}
+	}
+}
+
+func TestSourceAddressDial(t *testing.T) {
+	l, addr := fnet.Listen("test-source-addr", "127.0.0.1:0")
+	if l == nil {
+		t.Fatalf("Unable to listen")
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	var nilSource *fnet.SourceAddress
+	conn, err := nilSource.DialContext(context.Background(), &net.Dialer{}, "tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Unexpected error dialing with nil source: %v", err)
+	}
+	conn.Close()
+	s, err := fnet.GetSourceAddress("127.0.0.1,127.0.0.2")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, expected := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"} {
+		conn, err = s.DialContext(context.Background(), &net.Dialer{}, "tcp", addr.String())
+		if err != nil {
+			t.Fatalf("Unexpected error dialing: %v", err)
+		}
+		local := conn.LocalAddr().(*net.TCPAddr)
+		if local.IP.String() != expected {
+			t.Errorf("Expected local ip %s, got %v", expected, local)
+		}
+		conn.Close()
+	}
+}
+
 // --- max logging for tests
 
 func init() {
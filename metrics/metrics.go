@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/rapi"
 	"fortio.org/log"
 	"fortio.org/scli"
@@ -45,4 +46,5 @@ fortio_running `)
 fortio_runs_total `)
 	_, _ = io.WriteString(w, strconv.FormatInt(total, 10))
 	_, _ = io.WriteString(w, "\n")
+	fhttp.WriteServerMetrics(w)
 }
@@ -61,6 +61,35 @@ type Runnable interface {
 	Run(context.Context, ThreadID) (status bool, details string)
 }
 
+// Pacer is an optional interface a Runnable can also implement to schedule
+// its own calls (e.g. replaying recorded inter arrival times). It's best used
+// with QPS <= 0 (max speed). WaitNext is called before each Run() and the time
+// spent waiting isn't included in the Run() latency. It returns false to end
+// the thread's run. The stop channel is closed when the run is interrupted.
+type Pacer interface {
+	WaitNext(stop <-chan struct{}) bool
+}
+
+// RequestStarter is an optional interface a Runnable can also implement when
+// the request completed by a Run() may have been sent earlier (e.g. http
+// pipelining). When RequestStart() returns a non zero time after Run(), the
+// latency is measured from that time instead of from the call to Run().
+type RequestStarter interface {
+	RequestStart() time.Time
+}
+
+// Batcher is an optional interface a Runnable can also implement when a Run()
+// may send several requests at once (e.g. http pipelining), the following Run()s
+// then only complete the requests already sent.
+type Batcher interface {
+	// MaxBatch is called before each Run() with the number of calls left for the
+	// thread (or 0 when unlimited): no more requests than that should be sent.
+	MaxBatch(n int64)
+	// Pending returns whether requests already sent are still to be completed,
+	// in which case the next Run() is done right away, without pacing.
+	Pending() bool
+}
+
 // MakeRunners creates an array of NumThreads identical Runnable instances
 // (for the (rare/test) cases where there is no unique state needed).
 func (r *RunnerOptions) MakeRunners(rr Runnable) {
@@ -731,6 +760,10 @@ func runOne(id ThreadID, runnerChan chan struct{}, funcTimes, errTimes, sleepTim
 	hasDuration := (r.Duration > 0)
 	useExactly := (r.Exactly > 0)
 	f := r.Runners[id]
+	pacer, hasPacer := f.(Pacer)
+	starter, hasStarter := f.(RequestStarter)
+	batcher, hasBatcher := f.(Batcher)
+	limitedCalls := useExactly || (useQPS && hasDuration)
 	if useQPS && r.Uniform {
 		delayBetweenRequest := 1. / perThreadQPS
 		// When using uniform mode, we should wait a bit relative to our QPS and thread ID.
@@ -751,8 +784,12 @@ func runOne(id ThreadID, runnerChan chan struct{}, funcTimes, errTimes, sleepTim
 	var ctx2 context.Context
 MainLoop:
 	for {
+		batchPending := hasBatcher && batcher.Pending()
+		if !batchPending && hasPacer && !pacer.WaitNext(runnerChan) {
+			break
+		}
 		fStart := time.Now()
-		if !useExactly && (hasDuration && fStart.After(endTime)) {
+		if !batchPending && !useExactly && (hasDuration && fStart.After(endTime)) {
 			if !useQPS {
 				// max speed test reached end:
 				break
@@ -768,7 +805,15 @@ MainLoop:
 		if r.AccessLogger != nil {
 			ctx2 = r.AccessLogger.Start(ctx, id, i, fStart)
 		}
+		if hasBatcher && limitedCalls {
+			batcher.MaxBatch(numCalls - i)
+		}
 		status, details := f.Run(ctx2, id)
+		if hasStarter {
+			if reqStart := starter.RequestStart(); !reqStart.IsZero() {
+				fStart = reqStart
+			}
+		}
 		latency := time.Since(fStart).Seconds()
 		if r.AccessLogger != nil {
 			r.AccessLogger.Report(ctx2, id, i, fStart, latency, status, details)
@@ -777,6 +822,19 @@ MainLoop:
 		if !status {
 			errTimes.Record(latency)
 		}
+		if hasBatcher && batcher.Pending() {
+			// the rest of the batch was sent at the same time: no pacing until it's completed
+			i++
+			if limitedCalls && i >= numCalls {
+				break
+			}
+			select {
+			case <-runnerChan:
+				break MainLoop
+			default:
+				continue
+			}
+		}
 		// if using QPS / pre calc expected call # mode:
 		if useQPS { //nolint:nestif
 			for {
@@ -20,6 +20,7 @@ import (
 	"math"
 	"os"
 	"path"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
@@ -527,6 +528,118 @@ func TestSleepFallingBehind(t *testing.T) {
 	}
 }
 
+type testPacer struct {
+	Noop
+	left int
+}
+
+func (p *testPacer) WaitNext(stop <-chan struct{}) bool {
+	if p.left <= 0 {
+		return false
+	}
+	p.left--
+	select {
+	case <-stop:
+		return false
+	case <-time.After(20 * time.Millisecond):
+		return true
+	}
+}
+
+func TestPacer(t *testing.T) {
+	o := RunnerOptions{
+		QPS:        -1,
+		NumThreads: 2,
+		Duration:   -1, // the pacer ends the run
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().Runners[0] = &testPacer{left: 3}
+	r.Options().Runners[1] = &testPacer{left: 5}
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count != 8 {
+		t.Errorf("Pacer should have allowed 8 calls, got %d", res.DurationHistogram.Count)
+	}
+	// The 20ms wait isn't part of the latency:
+	if res.DurationHistogram.Max > 0.010 {
+		t.Errorf("Pacer wait time shouldn't be counted in latency, got max %g", res.DurationHistogram.Max)
+	}
+}
+
+type testStarter struct {
+	Noop
+}
+
+// RequestStart pretends the request was sent 50ms before Run() was called.
+func (s *testStarter) RequestStart() time.Time {
+	return time.Now().Add(-50 * time.Millisecond)
+}
+
+func TestRequestStarter(t *testing.T) {
+	o := RunnerOptions{
+		QPS:        -1,
+		NumThreads: 1,
+		Exactly:    3,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().Runners[0] = &testStarter{}
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count != 3 || res.DurationHistogram.Min < 0.050 {
+		t.Errorf("Latency should be measured from RequestStart(), got %d calls min %g",
+			res.DurationHistogram.Count, res.DurationHistogram.Min)
+	}
+}
+
+type testBatcher struct {
+	Noop
+	maxBatch []int64
+	pending  int64
+}
+
+// Run sends a batch of (up to) 3 when none is pending.
+func (b *testBatcher) Run(context.Context, ThreadID) (bool, string) {
+	if b.pending > 0 {
+		b.pending--
+		return true, ""
+	}
+	n := b.maxBatch[len(b.maxBatch)-1]
+	if n > 3 {
+		n = 3
+	}
+	b.pending = n - 1
+	return true, ""
+}
+
+func (b *testBatcher) MaxBatch(n int64) {
+	b.maxBatch = append(b.maxBatch, n)
+}
+
+func (b *testBatcher) Pending() bool {
+	return b.pending > 0
+}
+
+func TestBatcher(t *testing.T) {
+	o := RunnerOptions{
+		QPS:        10,
+		NumThreads: 1,
+		Exactly:    5,
+	}
+	r := NewPeriodicRunner(&o)
+	b := &testBatcher{}
+	r.Options().Runners[0] = b
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	// 2 batches (3 then 2 calls) so only 1 pacing sleep of 3 calls at 10 qps.
+	if res.DurationHistogram.Count != 5 || res.ActualDuration > 400*time.Millisecond {
+		t.Errorf("Expected 5 calls without pacing within batches, got %d in %v", res.DurationHistogram.Count, res.ActualDuration)
+	}
+	expected := []int64{5, 4, 3, 2, 1}
+	if !reflect.DeepEqual(b.maxBatch, expected) {
+		t.Errorf("Got MaxBatch %v, expected %v", b.maxBatch, expected)
+	}
+}
+
 func Test2Watchers(t *testing.T) {
 	// Wait for previous test to cleanup watchers
 	time.Sleep(200 * time.Millisecond)
@@ -33,9 +33,11 @@ import (
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/jrpc"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/sserunner"
 	"fortio.org/fortio/stats"
 	"fortio.org/fortio/tcprunner"
 	"fortio.org/fortio/udprunner"
+	"fortio.org/fortio/wsrunner"
 	"fortio.org/log"
 )
 
@@ -45,6 +47,7 @@ const (
 	RestStopURI   = "rest/stop"
 	RestDNS       = "rest/dns"
 	ModeGRPC      = "grpc"
+	ModeSSE       = "sse"
 )
 
 type StateEnum int
@@ -164,6 +167,17 @@ func getConfigAtPath(path string, m map[string]interface{}) (map[string]interfac
 	return getConfigAtPath(rest, mm)
 }
 
+// listValue returns the comma separated list FormValue of key, nil when empty.
+func listValue(r *http.Request, json map[string]interface{}, key string) []string {
+	var res []string
+	for _, v := range strings.Split(FormValue(r, json, key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 // FormValue gets the value from the query arguments/url parameter or from the
 // provided map (json data).
 func FormValue(r *http.Request, json map[string]interface{}, key string) string {
@@ -224,6 +238,7 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { //nolint:funlen
 	log.Infof("Starting API run %s load request from %v for %s", runner, r.RemoteAddr, url)
 	async := (FormValue(r, jd, "async") == "on")
 	payload := FormValue(r, jd, "payload")
+	method := strings.ToUpper(strings.TrimSpace(FormValue(r, jd, "X")))
 	labels := FormValue(r, jd, "labels")
 	resolution, _ := strconv.ParseFloat(FormValue(r, jd, "r"), 64)
 	percList, _ := stats.ParsePercentiles(FormValue(r, jd, "p"))
@@ -287,6 +302,34 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { //nolint:funlen
 	httpopts.Resolve = resolve
 	httpopts.H2 = h2
 	httpopts.LogErrors = logErrors
+	httpopts.MethodOverride = method
+	httpopts.MinVersion = FormValue(r, jd, "tls-min")
+	httpopts.MaxVersion = FormValue(r, jd, "tls-max")
+	httpopts.CipherSuites = listValue(r, jd, "tls-ciphers")
+	httpopts.Curves = listValue(r, jd, "tls-curves")
+	httpopts.ServerName = FormValue(r, jd, "sni")
+	httpopts.ALPN = listValue(r, jd, "alpn")
+	httpopts.Resumption = FormValue(r, jd, "tls-resumption")
+	httpopts.Cookies = (FormValue(r, jd, "cookies") == "on")
+	if login := FormValue(r, jd, "login"); login != "" {
+		httpopts.Login = &fhttp.LoginRequest{
+			URL:       login,
+			Payload:   FormValue(r, jd, "login-payload"),
+			TokenPath: FormValue(r, jd, "login-token"),
+		}
+	}
+	retries, _ := strconv.Atoi(FormValue(r, jd, "retries"))
+	retryOn := FormValue(r, jd, "retry-on")
+	if retryOn == "" {
+		retryOn = "socket"
+	}
+	retryBackoff, _ := time.ParseDuration(FormValue(r, jd, "retry-backoff"))
+	retryMaxBackoff, _ := time.ParseDuration(FormValue(r, jd, "retry-max-backoff"))
+	httpopts.Retry, err = fhttp.NewRetryPolicy(retries, retryOn, retryBackoff, retryMaxBackoff)
+	if err != nil {
+		Error(w, "invalid retry-on", err)
+		return
+	}
 	// Set the connection reuse range.
 	err = bincommon.ConnectionReuseRange.
 		WithValidator(bincommon.ConnectionReuseRangeValidator(httpopts)).
@@ -368,6 +411,8 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 			UsePing:       grpcPing,
 			Delay:         grpcPingDelay,
 			Service:       FormValue(r, jd, "healthservice"),
+			SourceAddress: httpopts.SourceAddress,
+			Retry:         httpopts.Retry,
 		}
 		o.TLSOptions = httpopts.TLSOptions
 		if grpcSecure {
@@ -376,6 +421,17 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 		aborter = UpdateRun(&o.RunnerOptions)
 		// TODO: ReqTimeout: timeout
 		res, err = fgrpc.RunGRPCTest(&o)
+	} else if runner == ModeSSE {
+		o := sserunner.RunnerOptions{
+			RunnerOptions: *ro,
+		}
+		o.ReqTimeout = httpopts.HTTPReqTimeOut
+		o.Destination = url
+		o.Headers = httpopts.AllHeaders()
+		o.TimestampField = FormValue(r, jd, "sse-timestamp")
+		o.TLSOptions = httpopts.TLSOptions
+		aborter = UpdateRun(&o.RunnerOptions)
+		res, err = sserunner.RunSSETest(&o)
 	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) {
 		// TODO: copy pasta from fortio_main
 		o := tcprunner.RunnerOptions{
@@ -384,6 +440,7 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 		o.ReqTimeout = httpopts.HTTPReqTimeOut
 		o.Destination = url
 		o.Payload = httpopts.Payload
+		o.SourceAddress = httpopts.SourceAddress
 		aborter = UpdateRun(&o.RunnerOptions)
 		res, err = tcprunner.RunTCPTest(&o)
 	} else if strings.HasPrefix(url, udprunner.UDPURLPrefix) {
@@ -394,8 +451,21 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 		o.ReqTimeout = httpopts.HTTPReqTimeOut
 		o.Destination = url
 		o.Payload = httpopts.Payload
+		o.SourceAddress = httpopts.SourceAddress
 		aborter = UpdateRun(&o.RunnerOptions)
 		res, err = udprunner.RunUDPTest(&o)
+	} else if wsrunner.IsWebSocketURL(url) {
+		// TODO: copy pasta from fortio_main
+		o := wsrunner.RunnerOptions{
+			RunnerOptions: *ro,
+		}
+		o.ReqTimeout = httpopts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpopts.Payload
+		o.Headers = httpopts.AllHeaders()
+		o.TLSOptions = httpopts.TLSOptions
+		aborter = UpdateRun(&o.RunnerOptions)
+		res, err = wsrunner.RunWSTest(&o)
 	} else {
 		o := fhttp.HTTPRunnerOptions{
 			HTTPOptions:        *httpopts,
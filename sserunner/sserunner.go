@@ -0,0 +1,475 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sserunner is the Server-Sent Events (SSE) consumer load runner: each thread
+// keeps a stream open, reconnecting when it ends, and each call waits for the next event.
+// It reports the events delivery latency, from their embedded timestamps, the gaps between
+// consecutive events, the reconnects and the stream errors.
+package sserunner // import "fortio.org/fortio/sserunner"
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+	"fortio.org/log"
+)
+
+type SSEResultMap map[string]int64
+
+// RunnerResults is the aggregated result of a SSE run.
+// Also is the internal type used per thread/goroutine.
+type RunnerResults struct {
+	periodic.RunnerResults
+	SSEOptions
+	RetCodes SSEResultMap
+	// LatencyHistogram is the delivery latency of the events having a timestamp
+	// (receive time minus the event's timestamp, so the clocks must be in sync).
+	LatencyHistogram *stats.HistogramData
+	// GapHistogram is the time between consecutive events received by a thread (reconnects included).
+	GapHistogram  *stats.HistogramData
+	Events        int64
+	Streams       int64 // number of connections
+	Reconnects    int64
+	StreamErrors  int64
+	BytesReceived int64
+	client        *SSEClient
+	latency       *stats.Histogram
+	gaps          *stats.Histogram
+	aborter       *periodic.Aborter
+}
+
+// Run waits for the next event. Main call being run, as fast as the server sends events.
+// To be set as the Function in RunnerOptions.
+func (ssestate *RunnerResults) Run(ctx context.Context, t periodic.ThreadID) (bool, string) {
+	log.Debugf("Calling in %d", t)
+	ev, err := ssestate.client.Next(ctx)
+	if err != nil {
+		errStr := err.Error()
+		ssestate.RetCodes[errStr]++
+		return false, errStr
+	}
+	if !ev.ts.IsZero() {
+		ssestate.latency.Record(ev.recv.Sub(ev.ts).Seconds())
+	}
+	if !ev.prev.IsZero() {
+		ssestate.gaps.Record(ev.recv.Sub(ev.prev).Seconds())
+	}
+	ssestate.RetCodes[SSEStatusOK]++
+	return true, SSEStatusOK
+}
+
+// SSEOptions are options to the SSEClient.
+type SSEOptions struct {
+	Destination string
+	Headers     http.Header // additional request headers
+	// Maximum time to wait for an event, the stream is reconnected after such a timeout.
+	ReqTimeout time.Duration
+	// Name of the json data field holding the event timestamp: unix time in seconds, milliseconds,
+	// microseconds or nanoseconds (told apart by magnitude), or a RFC3339 string. Defaults to "ts".
+	TimestampField string
+	fhttp.TLSOptions
+}
+
+// RunnerOptions includes the base RunnerOptions plus SSE specific
+// options.
+type RunnerOptions struct {
+	periodic.RunnerOptions
+	SSEOptions
+}
+
+// Event is a received event.
+type Event struct {
+	ID   string
+	Data string
+	// Time at which the event was received, its timestamp (zero if not found in the data)
+	// and the receive time of the previous event.
+	recv, ts, prev time.Time
+	err            error         // stream ended (io.EOF) or failed
+	retry          time.Duration // with err, the last retry field of the stream if any
+}
+
+// SSEClient is the client used for SSE testing.
+type SSEClient struct {
+	client        *http.Client
+	headers       http.Header
+	destination   string
+	tsField       string
+	timeout       time.Duration
+	events        chan Event
+	cancel        context.CancelFunc
+	lastID        string
+	lastRecv      time.Time
+	retry         time.Duration // reconnection delay set by the server
+	nextConnect   time.Time     // not reconnecting before
+	streams       int64
+	reconnects    int64
+	streamErrors  int64
+	eventCount    int64
+	bytesReceived int64
+}
+
+var (
+	// SSEStatusOK is the map key on success.
+	SSEStatusOK = "OK"
+	// SSEEventsBuffer is the number of events each stream reads ahead.
+	SSEEventsBuffer = 100
+	// SSEMinReconnectDelay is the minimum wait before reconnecting after a stream ended or failed,
+	// the server can ask for a longer one (up to SSEMaxReconnectDelay) with the retry field.
+	SSEMinReconnectDelay = 100 * time.Millisecond
+	SSEMaxReconnectDelay = time.Minute
+	errTimeout           = errors.New("timeout waiting for event")
+	errNotStream         = errors.New("not an event stream")
+)
+
+// NewSSEClient creates and initialize and returns a client based on the SSEOptions.
+func NewSSEClient(o *SSEOptions) (*SSEClient, error) {
+	c := SSEClient{destination: o.Destination, tsField: o.TimestampField, headers: make(http.Header)}
+	if c.tsField == "" {
+		c.tsField = "ts"
+	}
+	req, err := http.NewRequest(http.MethodGet, o.Destination, nil)
+	if err != nil {
+		log.Errf("Invalid SSE destination %q: %v", o.Destination, err)
+		return nil, err
+	}
+	tr := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if req.URL.Scheme == "https" {
+		if tr.TLSClientConfig, err = o.TLSOptions.TLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	c.client = &http.Client{Transport: tr} // no overall timeout, streams are long lived
+	for k, v := range o.Headers {
+		if strings.EqualFold(k, "Content-Type") || strings.EqualFold(k, "Content-Length") {
+			continue // no payload
+		}
+		c.headers[k] = v
+	}
+	c.headers.Set("Accept", fhttp.SSEContentType)
+	c.headers.Set("Cache-Control", "no-cache")
+	c.timeout = o.ReqTimeout
+	if o.ReqTimeout == 0 {
+		log.Debugf("Request timeout not set, using default %v", fhttp.HTTPReqTimeOutDefaultValue)
+		c.timeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	if c.timeout < 0 {
+		log.Warnf("Invalid timeout %v, setting to %v", c.timeout, fhttp.HTTPReqTimeOutDefaultValue)
+		c.timeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	return &c, nil
+}
+
+// connect opens a new stream, resuming after the last received event id if any.
+func (c *SSEClient) connect() error {
+	if c.streams > 0 {
+		c.reconnects++
+	}
+	c.streams++
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, c.destination, nil) // already validated
+	req.Header = c.headers.Clone()
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if c.lastID != "" {
+		req.Header.Set("Last-Event-ID", c.lastID)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		cancel()
+		log.Errf("Unable to connect to %v : %v", c.destination, err)
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		resp.Body.Close()
+		log.Errf("Bad status %d from %v", resp.StatusCode, c.destination)
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), fhttp.SSEContentType) {
+		cancel()
+		resp.Body.Close()
+		log.Errf("Unexpected content type %q from %v", resp.Header.Get("Content-Type"), c.destination)
+		return errNotStream
+	}
+	c.cancel = cancel
+	c.events = make(chan Event, SSEEventsBuffer)
+	go readEvents(resp.Body, c.events)
+	return nil
+}
+
+// readEvents parses the stream and sends the events (and then the error ending it) to the channel.
+func readEvents(body io.ReadCloser, events chan<- Event) {
+	defer close(events)
+	defer body.Close()
+	rd := bufio.NewReader(body)
+	var id string
+	var data strings.Builder
+	hasData := false
+	var retry time.Duration
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			events <- Event{err: err, retry: retry}
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" { // dispatch
+			if hasData {
+				events <- Event{ID: id, Data: data.String(), recv: time.Now()}
+			}
+			data.Reset()
+			hasData = false
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "id":
+			id = value
+		case "retry": // reconnection time in milliseconds, ignored if not only digits
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+				if ms > uint64(SSEMaxReconnectDelay/time.Millisecond) {
+					ms = uint64(SSEMaxReconnectDelay / time.Millisecond)
+				}
+				retry = time.Duration(ms) * time.Millisecond
+			}
+		case "": // comment
+		default: // event...
+		}
+	}
+}
+
+func (c *SSEClient) closeStream() {
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	if c.events != nil {
+		for range c.events { //nolint:revive // drain so the reader goroutine ends
+		}
+		c.events = nil
+	}
+}
+
+// delayReconnect sets the earliest next connection time, after the server's retry delay
+// or SSEMinReconnectDelay, so a stream ending or failing right away doesn't spin.
+func (c *SSEClient) delayReconnect() {
+	delay := c.retry
+	if delay < SSEMinReconnectDelay {
+		delay = SSEMinReconnectDelay
+	}
+	c.nextConnect = time.Now().Add(delay)
+}
+
+// waitReconnect waits until the next connection time, timeout or the context being done.
+func (c *SSEClient) waitReconnect(ctx context.Context, timeout <-chan time.Time) error {
+	wait := time.Until(c.nextConnect)
+	if wait <= 0 {
+		return nil
+	}
+	log.LogVf("Waiting %v before reconnecting to %s", wait, c.destination)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-timeout:
+		return errTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Next returns the next event, (re)connecting as needed.
+func (c *SSEClient) Next(ctx context.Context) (*Event, error) {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	for {
+		if c.events == nil {
+			if err := c.waitReconnect(ctx, timer.C); err != nil {
+				return nil, err
+			}
+			if err := c.connect(); err != nil {
+				c.delayReconnect()
+				c.streamErrors++
+				return nil, err
+			}
+		}
+		select {
+		case ev := <-c.events:
+			if ev.err != nil {
+				c.closeStream()
+				if ev.retry > 0 {
+					c.retry = ev.retry
+				}
+				c.delayReconnect()
+				if errors.Is(ev.err, io.EOF) { // ended by the server, reconnect
+					log.LogVf("SSE stream from %s ended after event %q", c.destination, c.lastID)
+					continue
+				}
+				log.Errf("Error reading SSE stream from %s: %v", c.destination, ev.err)
+				c.streamErrors++
+				return nil, ev.err
+			}
+			c.eventCount++
+			c.bytesReceived += int64(len(ev.Data))
+			if ev.ID != "" {
+				c.lastID = ev.ID
+			}
+			ev.prev = c.lastRecv
+			c.lastRecv = ev.recv
+			ev.ts = timestamp(ev.Data, c.tsField)
+			return &ev, nil
+		case <-timer.C:
+			log.Warnf("No SSE event from %s after %v, reconnecting", c.destination, c.timeout)
+			c.closeStream()
+			c.streamErrors++
+			return nil, errTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// timestamp returns the time in the field of the json data, zero if not found.
+func timestamp(data, field string) time.Time {
+	if !strings.HasPrefix(data, "{") {
+		return time.Time{}
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return time.Time{}
+	}
+	raw, found := m[field]
+	if !found {
+		return time.Time{}
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		t, _ := time.Parse(time.RFC3339Nano, s)
+		return t
+	}
+	v, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil || v <= 0 {
+		return time.Time{}
+	}
+	switch {
+	case v < 1e11: // seconds
+		return time.Unix(0, int64(v*1e9))
+	case v < 1e14: // milliseconds
+		return time.Unix(0, int64(v*1e6))
+	case v < 1e17: // microseconds
+		return time.Unix(0, int64(v*1e3))
+	default:
+		n, _ := strconv.ParseInt(string(raw), 10, 64) // nanoseconds, exact
+		return time.Unix(0, n)
+	}
+}
+
+// Close closes the current stream and returns the total number of streams used for the run.
+func (c *SSEClient) Close() int64 {
+	log.Debugf("Closing %p: %s streams count %d", c, c.destination, c.streams)
+	c.closeStream()
+	c.client.CloseIdleConnections()
+	return c.streams
+}
+
+// RunSSETest runs a SSE test and returns the aggregated stats.
+// The pace is the server's: the qps is ignored and each call waits for the next event.
+func RunSSETest(o *RunnerOptions) (*RunnerResults, error) {
+	o.RunType = "SSE"
+	o.QPS = -1 // max, i.e. as events come
+	log.Infof("Starting SSE test for %s with %d streams", o.Destination, o.NumThreads)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	resolution := r.Options().Resolution
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := RunnerResults{
+		aborter:  r.Options().Stop,
+		RetCodes: make(SSEResultMap),
+		latency:  stats.NewHistogram(0, resolution),
+		gaps:     stats.NewHistogram(0, resolution),
+	}
+	total.Destination = o.Destination
+	ssestate := make([]RunnerResults, numThreads)
+	var err error
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &ssestate[i]
+		// Create a client for each 'thread', connecting on first call.
+		ssestate[i].client, err = NewSSEClient(&o.SSEOptions)
+		if ssestate[i].client == nil {
+			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, o.Destination, err)
+		}
+		// Setup the stats for each 'thread'
+		ssestate[i].aborter = total.aborter
+		ssestate[i].RetCodes = make(SSEResultMap)
+		ssestate[i].latency = stats.NewHistogram(0, resolution)
+		ssestate[i].gaps = stats.NewHistogram(0, resolution)
+	}
+	total.RunnerResults = r.Run()
+	// Numthreads may have reduced but it should be ok to accumulate 0s from
+	// unused ones. We also must cleanup all the created clients.
+	keys := []string{}
+	for i := 0; i < numThreads; i++ {
+		c := ssestate[i].client
+		total.Streams += c.Close()
+		total.Events += c.eventCount
+		total.Reconnects += c.reconnects
+		total.StreamErrors += c.streamErrors
+		total.BytesReceived += c.bytesReceived
+		total.latency.Transfer(ssestate[i].latency)
+		total.gaps.Transfer(ssestate[i].gaps)
+		for k := range ssestate[i].RetCodes {
+			if _, exists := total.RetCodes[k]; !exists {
+				keys = append(keys, k)
+			}
+			total.RetCodes[k] += ssestate[i].RetCodes[k]
+		}
+	}
+	// Cleanup state:
+	r.Options().ReleaseRunners()
+	total.LatencyHistogram = total.latency.Export().CalcPercentiles(r.Options().Percentiles)
+	total.GapHistogram = total.gaps.Export().CalcPercentiles(r.Options().Percentiles)
+	total.LatencyHistogram.Print(out, "Events delivery latency")
+	total.GapHistogram.Print(out, "Gaps between events")
+	totalCount := float64(total.DurationHistogram.Count)
+	_, _ = fmt.Fprintf(out, "Streams: %d (for perfect no error run, would be %d), reconnects %d, stream errors %d\n",
+		total.Streams, r.Options().NumThreads, total.Reconnects, total.StreamErrors)
+	_, _ = fmt.Fprintf(out, "Total events received: %d, data bytes: %d\n", total.Events, total.BytesReceived)
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(out, "sse %s : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+	}
+	return &total, nil
+}
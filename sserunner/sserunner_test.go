@@ -0,0 +1,148 @@
+// Copyright 2023 Fortio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sserunner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+)
+
+func TestSSERunnerBadDestination(t *testing.T) {
+	opts := RunnerOptions{}
+	opts.Destination = "http://bad host/"
+	res, err := RunSSETest(&opts)
+	if err == nil {
+		t.Fatalf("unexpected success on bad destination %+v", res)
+	}
+	t.Logf("Got expected error: %v", err)
+}
+
+func TestTimestamp(t *testing.T) {
+	ref := time.Date(2023, 10, 19, 12, 34, 56, 789000000, time.UTC)
+	for _, tst := range []struct {
+		data     string
+		expected time.Time
+	}{
+		{fmt.Sprintf(`{"ts":%d}`, ref.UnixNano()), ref},
+		{fmt.Sprintf(`{"ts":%d}`, ref.UnixNano()/1000), ref},
+		{fmt.Sprintf(`{"ts":%d}`, ref.UnixNano()/1000000), ref},
+		{`{"ts":1697718896.789}`, ref},
+		{`{"ts":"2023-10-19T12:34:56.789Z", "x": 1}`, ref},
+		{`{"other":1}`, time.Time{}},
+		{`not json`, time.Time{}},
+		{`{"ts":"not a time"}`, time.Time{}},
+	} {
+		actual := timestamp(tst.data, "ts")
+		if d := actual.Sub(tst.expected); d > time.Microsecond || d < -time.Microsecond {
+			t.Errorf("timestamp(%s) got %v, expected %v", tst.data, actual, tst.expected)
+		}
+	}
+}
+
+func TestSSERunner(t *testing.T) {
+	_, addr := fhttp.ServeTCP("0", "")
+	opts := RunnerOptions{}
+	opts.NumThreads = 3
+	opts.Exactly = 30
+	// Each stream ends after 4 events so there are reconnects, resuming after the last id.
+	opts.Destination = fmt.Sprintf("http://localhost:%d/sse?event-rate=50&events=4&size=10", addr.Port)
+	res, err := RunSSETest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[SSEStatusOK] != 30 || res.Events != 30 || res.StreamErrors != 0 {
+		t.Errorf("Expected 30 ok events and no errors, got %v %d %d", res.RetCodes, res.Events, res.StreamErrors)
+	}
+	// 10 events per stream, 4 per connection: 3 connections each, so 2 reconnects.
+	if res.Streams != 9 || res.Reconnects != 6 {
+		t.Errorf("Expected 9 streams and 6 reconnects, got %d %d", res.Streams, res.Reconnects)
+	}
+	if res.LatencyHistogram.Count != 30 || res.LatencyHistogram.Max > 0.1 {
+		t.Errorf("Unexpected delivery latency %+v", res.LatencyHistogram)
+	}
+	if res.GapHistogram.Count != 27 || res.GapHistogram.Avg < 0.01 {
+		t.Errorf("Unexpected gaps (expecting ~20ms) %+v", res.GapHistogram)
+	}
+}
+
+func TestSSERunnerErrors(t *testing.T) {
+	_, addr := fhttp.ServeTCP("0", "")
+	opts := RunnerOptions{}
+	opts.NumThreads = 1
+	opts.Exactly = 2
+	opts.Destination = fmt.Sprintf("http://localhost:%d/sse?status=503", addr.Port)
+	res, err := RunSSETest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes["status 503"] != 2 || res.StreamErrors != 2 {
+		t.Errorf("Expected 2 status 503 errors, got %v %d", res.RetCodes, res.StreamErrors)
+	}
+	// Timeout waiting for events:
+	opts.ReqTimeout = 50 * time.Millisecond
+	opts.Destination = fmt.Sprintf("http://localhost:%d/sse?event-rate=1", addr.Port)
+	res, err = RunSSETest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[SSEStatusOK] != 1 || res.RetCodes[errTimeout.Error()] != 1 {
+		t.Errorf("Expected 1 event then a timeout, got %v", res.RetCodes)
+	}
+}
+
+func TestSSEClientReconnectDelay(t *testing.T) {
+	for _, tst := range []struct {
+		retry    string // retry field sent by the server before ending the stream
+		expected time.Duration
+	}{
+		{"", SSEMinReconnectDelay},
+		{"retry: 10\n", SSEMinReconnectDelay},
+		{"retry: 300\n", 300 * time.Millisecond},
+		{"retry: 3s\n", SSEMinReconnectDelay}, // not only digits, ignored
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", fhttp.SSEContentType)
+			fmt.Fprintf(w, "%sdata: x\n\n", tst.retry) // then ends the stream
+		}))
+		c, err := NewSSEClient(&SSEOptions{Destination: srv.URL, ReqTimeout: 2 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recv []time.Time
+		for i := 0; i < 3; i++ {
+			if _, err = c.Next(context.Background()); err != nil {
+				t.Fatalf("%q: unexpected error %v", tst.retry, err)
+			}
+			recv = append(recv, time.Now())
+		}
+		for i := 1; i < len(recv); i++ {
+			if d := recv[i].Sub(recv[i-1]); d < tst.expected || d > tst.expected+time.Second {
+				t.Errorf("%q: reconnected after %v, expected %v", tst.retry, d, tst.expected)
+			}
+		}
+		if c.streams != 3 || c.reconnects != 2 {
+			t.Errorf("%q: expected 3 streams and 2 reconnects, got %d %d", tst.retry, c.streams, c.reconnects)
+		}
+		c.closeStream()
+		srv.Close()
+	}
+}
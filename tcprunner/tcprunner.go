@@ -66,6 +66,7 @@ type TCPOptions struct {
 	Payload          []byte // what to send (and check)
 	UnixDomainSocket string // Path of unix domain socket to use instead of host:port from URL
 	ReqTimeout       time.Duration
+	SourceAddress    string // Optional local ips (and port range) to bind to, see fnet.GetSourceAddress()
 }
 
 // RunnerOptions includes the base RunnerOptions plus tcp specific
@@ -89,6 +90,7 @@ type TCPClient struct {
 	destination   string
 	doGenerate    bool
 	reqTimeout    time.Duration
+	source        *fnet.SourceAddress
 }
 
 var (
@@ -119,6 +121,9 @@ func NewTCPClient(o *TCPOptions) (*TCPClient, error) {
 		return nil, err
 	}
 	c.dest = tAddr
+	if c.source, err = fnet.GetSourceAddress(o.SourceAddress); err != nil {
+		return nil, err
+	}
 	c.req = o.Payload
 	if len(c.req) == 0 { // len(nil) array is also valid and 0
 		c.doGenerate = true
@@ -139,7 +144,7 @@ func NewTCPClient(o *TCPOptions) (*TCPClient, error) {
 
 func (c *TCPClient) connect() (net.Conn, error) {
 	c.socketCount++
-	socket, err := net.Dial(c.dest.Network(), c.dest.String())
+	socket, err := c.source.DialContext(context.Background(), &net.Dialer{}, c.dest.Network(), c.dest.String())
 	if err != nil {
 		log.Errf("Unable to connect to %v : %v", c.dest, err)
 		return nil, err
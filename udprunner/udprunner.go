@@ -65,9 +65,10 @@ func (udpstate *RunnerResults) Run(_ context.Context, t periodic.ThreadID) (bool
 
 // UDPOptions are options to the UDPClient.
 type UDPOptions struct {
-	Destination string
-	Payload     []byte // what to send (and check)
-	ReqTimeout  time.Duration
+	Destination   string
+	Payload       []byte // what to send (and check)
+	ReqTimeout    time.Duration
+	SourceAddress string // Optional local ips (and port range) to bind to, see fnet.GetSourceAddress()
 }
 
 // RunnerOptions includes the base RunnerOptions plus udp specific
@@ -91,6 +92,7 @@ type UDPClient struct {
 	destination   string
 	doGenerate    bool
 	reqTimeout    time.Duration
+	source        *fnet.SourceAddress
 }
 
 var (
@@ -114,6 +116,9 @@ func NewUDPClient(o *UDPOptions) (*UDPClient, error) {
 		return nil, err
 	}
 	c.dest = tAddr
+	if c.source, err = fnet.GetSourceAddress(o.SourceAddress); err != nil {
+		return nil, err
+	}
 	c.req = o.Payload
 	if len(c.req) == 0 { // len(nil) array is also valid and 0
 		c.doGenerate = true
@@ -134,7 +139,7 @@ func NewUDPClient(o *UDPOptions) (*UDPClient, error) {
 
 func (c *UDPClient) connect() (net.Conn, error) {
 	c.socketCount++
-	socket, err := net.Dial(c.dest.Network(), c.dest.String())
+	socket, err := c.source.DialContext(context.Background(), &net.Dialer{}, c.dest.Network(), c.dest.String())
 	if err != nil {
 		log.Errf("Unable to connect to %v : %v", c.dest, err)
 		return nil, err
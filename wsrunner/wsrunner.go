@@ -0,0 +1,278 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wsrunner is the WebSocket load runner: each thread keeps a connection
+// open and measures the round trip time of messages, which the server is expected
+// to reply to with one message each (like the fortio echo server does).
+package wsrunner // import "fortio.org/fortio/wsrunner"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/tcprunner"
+	"fortio.org/log"
+	"golang.org/x/net/websocket"
+)
+
+type WSResultMap map[string]int64
+
+// RunnerResults is the aggregated result of a WSRunner.
+// Also is the internal type used per thread/goroutine.
+type RunnerResults struct {
+	periodic.RunnerResults
+	WSOptions
+	RetCodes      WSResultMap
+	SocketCount   int
+	BytesSent     int64
+	BytesReceived int64
+	client        *WSClient
+	aborter       *periodic.Aborter
+}
+
+// Run tests websocket messages round trip. Main call being run at the target QPS.
+// To be set as the Function in RunnerOptions.
+func (wsstate *RunnerResults) Run(_ context.Context, t periodic.ThreadID) (bool, string) {
+	log.Debugf("Calling in %d", t)
+	_, err := wsstate.client.Fetch()
+	if err != nil {
+		errStr := err.Error()
+		wsstate.RetCodes[errStr]++
+		return false, errStr
+	}
+	wsstate.RetCodes[WSStatusOK]++
+	return true, WSStatusOK
+}
+
+// WSOptions are options to the WSClient.
+type WSOptions struct {
+	Destination string
+	Payload     []byte      // what to send, as binary messages, instead of generated text ones
+	Headers     http.Header // additional handshake request headers
+	ReqTimeout  time.Duration
+	fhttp.TLSOptions
+}
+
+// RunnerOptions includes the base RunnerOptions plus websocket specific
+// options.
+type RunnerOptions struct {
+	periodic.RunnerOptions
+	WSOptions
+}
+
+// WSClient is the client used for websocket testing.
+type WSClient struct {
+	config        *websocket.Config
+	msg           fhttp.WSMessage
+	reply         fhttp.WSMessage
+	conn          *websocket.Conn
+	connID        int // 0-9999
+	messageCount  int64
+	bytesSent     int64
+	bytesReceived int64
+	socketCount   int
+	destination   string
+	doGenerate    bool
+	reqTimeout    time.Duration
+}
+
+var (
+	// WSURLPrefix is the URL prefix for triggering websocket load.
+	WSURLPrefix = "ws://"
+	// WSSURLPrefix is the URL prefix for triggering secure websocket load.
+	WSSURLPrefix = "wss://"
+	// WSStatusOK is the map key on success.
+	WSStatusOK = "OK"
+)
+
+// IsWebSocketURL returns true for ws:// and wss:// urls.
+func IsWebSocketURL(url string) bool {
+	return strings.HasPrefix(url, WSURLPrefix) || strings.HasPrefix(url, WSSURLPrefix)
+}
+
+// NewWSClient creates and initialize and returns a client based on the WSOptions.
+func NewWSClient(o *WSOptions) (*WSClient, error) {
+	c := WSClient{}
+	c.destination = o.Destination
+	// Origin is required by the protocol, use the http(s) equivalent of the destination.
+	origin := "http" + strings.TrimPrefix(o.Destination, "ws")
+	var err error
+	c.config, err = websocket.NewConfig(o.Destination, origin)
+	if err != nil {
+		log.Errf("Invalid websocket destination %q: %v", o.Destination, err)
+		return nil, err
+	}
+	if strings.HasPrefix(o.Destination, WSSURLPrefix) {
+		if c.config.TlsConfig, err = o.TLSOptions.TLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range o.Headers {
+		if strings.EqualFold(k, "Content-Type") || strings.EqualFold(k, "Content-Length") {
+			continue // from the payload, not for the handshake
+		}
+		c.config.Header[k] = v
+	}
+	c.msg = fhttp.WSMessage{Data: o.Payload, PayloadType: websocket.BinaryFrame}
+	if len(o.Payload) == 0 {
+		c.doGenerate = true
+		c.msg = fhttp.WSMessage{Data: tcprunner.GeneratePayload(0, 0), PayloadType: websocket.TextFrame}
+	}
+	c.reqTimeout = o.ReqTimeout
+	if o.ReqTimeout == 0 {
+		log.Debugf("Request timeout not set, using default %v", fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	if c.reqTimeout < 0 {
+		log.Warnf("Invalid timeout %v, setting to %v", c.reqTimeout, fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	return &c, nil
+}
+
+func (c *WSClient) connect() (*websocket.Conn, error) {
+	c.socketCount++
+	conn, err := websocket.DialConfig(c.config)
+	if err != nil {
+		log.Errf("Unable to connect to %v : %v", c.destination, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Fetch sends a message and waits for the reply, (re)connecting if needed.
+// Returns the reply's data.
+func (c *WSClient) Fetch() ([]byte, error) {
+	// Connect or reuse existing connection:
+	conn := c.conn
+	c.messageCount++
+	reuse := (conn != nil)
+	if !reuse {
+		var err error
+		conn, err = c.connect()
+		if conn == nil {
+			return nil, err
+		}
+	}
+	c.conn = nil // because of error returns and single retry
+	conErr := conn.SetDeadline(time.Now().Add(c.reqTimeout))
+	if c.doGenerate {
+		c.msg.Data = tcprunner.GeneratePayload(c.connID, c.messageCount)
+	}
+	err := fhttp.WSMessageCodec.Send(conn, &c.msg)
+	if err != nil || conErr != nil {
+		_ = conn.Close()
+		if reuse {
+			// it's ok for the (idle) connection to die once, auto reconnect:
+			log.Infof("Closing dead websocket %d (%v)", c.connID, err)
+			return c.Fetch() // recurse once
+		}
+		log.Errf("[%d] Unable to send to %v: %v %v", c.connID, c.destination, err, conErr)
+		return nil, err
+	}
+	c.bytesSent += int64(len(c.msg.Data))
+	err = fhttp.WSMessageCodec.Receive(conn, &c.reply)
+	if err != nil {
+		log.Errf("[%d] Unable to receive from %v: %v", c.connID, c.destination, err)
+		_ = conn.Close()
+		return nil, err
+	}
+	c.bytesReceived += int64(len(c.reply.Data))
+	if log.LogDebug() {
+		log.Debugf("[%d] sent %d, received %d (%s)", c.connID, len(c.msg.Data), len(c.reply.Data),
+			fnet.DebugSummary(c.reply.Data, 256))
+	}
+	c.conn = conn // reuse on success
+	return c.reply.Data, nil
+}
+
+// Close closes the last connection and returns the total number of connections used for the run.
+func (c *WSClient) Close() int {
+	log.Debugf("Closing %p: %s socket count %d", c, c.destination, c.socketCount)
+	if c.conn != nil {
+		if err := c.conn.Close(); err != nil {
+			log.Warnf("Error closing websocket client's connection: %v", err)
+		}
+		c.conn = nil
+	}
+	return c.socketCount
+}
+
+// RunWSTest runs a websocket test and returns the aggregated stats.
+func RunWSTest(o *RunnerOptions) (*RunnerResults, error) {
+	o.RunType = "WebSocket"
+	log.Infof("Starting websocket test for %s with %d threads at %.1f qps", o.Destination, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := RunnerResults{
+		aborter:  r.Options().Stop,
+		RetCodes: make(WSResultMap),
+	}
+	total.Destination = o.Destination
+	wsstate := make([]RunnerResults, numThreads)
+	var err error
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &wsstate[i]
+		// Create a client and connect once for each 'thread'
+		wsstate[i].client, err = NewWSClient(&o.WSOptions)
+		if wsstate[i].client == nil {
+			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, o.Destination, err)
+		}
+		wsstate[i].client.connID = i
+		if o.Exactly <= 0 {
+			data, err := wsstate[i].client.Fetch()
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first hit of %s: err %v, received %d: %q", o.Destination, err, len(data), data)
+			}
+		}
+		// Setup the stats for each 'thread'
+		wsstate[i].aborter = total.aborter
+		wsstate[i].RetCodes = make(WSResultMap)
+	}
+	total.RunnerResults = r.Run()
+	// Numthreads may have reduced but it should be ok to accumulate 0s from
+	// unused ones. We also must cleanup all the created clients.
+	keys := []string{}
+	for i := 0; i < numThreads; i++ {
+		total.SocketCount += wsstate[i].client.Close()
+		total.BytesReceived += wsstate[i].client.bytesReceived
+		total.BytesSent += wsstate[i].client.bytesSent
+		for k := range wsstate[i].RetCodes {
+			if _, exists := total.RetCodes[k]; !exists {
+				keys = append(keys, k)
+			}
+			total.RetCodes[k] += wsstate[i].RetCodes[k]
+		}
+	}
+	// Cleanup state:
+	r.Options().ReleaseRunners()
+	totalCount := float64(total.DurationHistogram.Count)
+	_, _ = fmt.Fprintf(out, "Connections used: %d (for perfect no error run, would be %d)\n",
+		total.SocketCount, r.Options().NumThreads)
+	_, _ = fmt.Fprintf(out, "Total Bytes sent: %d, received: %d\n", total.BytesSent, total.BytesReceived)
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(out, "websocket %s : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+	}
+	return &total, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Fortio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package wsrunner
+
+import (
+	"fmt"
+	"testing"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/fnet"
+)
+
+func TestWSRunnerBadDestination(t *testing.T) {
+	opts := RunnerOptions{}
+	opts.QPS = 100
+	opts.Destination = "not a url"
+	res, err := RunWSTest(&opts)
+	if err == nil {
+		t.Fatalf("unexpected success on bad destination %+v", res)
+	}
+	t.Logf("Got expected error: %v", err)
+}
+
+func TestIsWebSocketURL(t *testing.T) {
+	for _, tst := range []struct {
+		url      string
+		expected bool
+	}{
+		{"ws://localhost:8080/", true},
+		{"wss://localhost/foo", true},
+		{"http://localhost:8080/", false},
+		{"tcp://localhost:8080/", false},
+	} {
+		if actual := IsWebSocketURL(tst.url); actual != tst.expected {
+			t.Errorf("IsWebSocketURL(%q) got %v, expected %v", tst.url, actual, tst.expected)
+		}
+	}
+}
+
+func TestWSRunner(t *testing.T) {
+	_, addr := fhttp.ServeTCP("0", "")
+	opts := RunnerOptions{}
+	opts.QPS = 100
+	opts.Destination = fmt.Sprintf("ws://localhost:%d/ws", addr.Port)
+	res, err := RunWSTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalReq := res.DurationHistogram.Count
+	wsOk := res.RetCodes[WSStatusOK]
+	if totalReq != wsOk || totalReq == 0 {
+		t.Errorf("Mismatch between requests %d and ok %v", totalReq, res.RetCodes)
+	}
+	if res.SocketCount != res.RunnerResults.NumThreads {
+		t.Errorf("%d connections used, expected same as thread# %d", res.SocketCount, res.RunnerResults.NumThreads)
+	}
+	if res.BytesReceived != res.BytesSent {
+		t.Errorf("Bytes received %d should bytes sent %d", res.BytesReceived, res.BytesSent)
+	}
+}
+
+func TestWSRunnerPayloadAndSize(t *testing.T) {
+	_, addr := fhttp.ServeTCP("0", "")
+	opts := RunnerOptions{}
+	opts.QPS = 10
+	opts.Exactly = 20
+	opts.NumThreads = 2
+	opts.Payload = fnet.GenerateRandomPayload(5000)
+	opts.Destination = fmt.Sprintf("ws://localhost:%d/ws?size=100", addr.Port)
+	res, err := RunWSTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[WSStatusOK] != 20 {
+		t.Errorf("Expected 20 ok messages, got %v", res.RetCodes)
+	}
+	if res.BytesSent != 20*5000 || res.BytesReceived != 20*100 {
+		t.Errorf("Unexpected bytes sent %d and received %d", res.BytesSent, res.BytesReceived)
+	}
+}
+
+func TestWSRunnerNoServer(t *testing.T) {
+	opts := RunnerOptions{}
+	opts.QPS = 10
+	opts.Exactly = 3
+	opts.NumThreads = 1
+	opts.Destination = "ws://localhost:1/" // nothing listening on port 1
+	res, err := RunWSTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[WSStatusOK] != 0 || res.SocketCount != 3 {
+		t.Errorf("Expected only errors, one connection attempt per message: %v %d", res.RetCodes, res.SocketCount)
+	}
+}